@@ -7,11 +7,21 @@ type NatsBucket struct {
 }
 
 func NewNatsBucket(bucket string) (*NatsBucket, error) {
+	return NewNatsBucketInNamespace("", bucket)
+}
+
+func NewNatsBucketInNamespace(namespace string, bucket string) (*NatsBucket, error) {
+	return NewNatsBucketWithConfig(namespace, &nats.KeyValueConfig{Bucket: bucket})
+}
+
+func NewNatsBucketWithConfig(namespace string, conf *nats.KeyValueConfig) (*NatsBucket, error) {
 	js, err := GetJs()
 	if err != nil {
 		return nil, err
 	}
-	keyValue, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	kvConf := *conf
+	kvConf.Bucket = withNamespace(resolveNamespace(namespace), conf.Bucket, dash)
+	keyValue, err := js.CreateKeyValue(&kvConf)
 	if err != nil {
 		return nil, err
 	}
@@ -31,3 +41,31 @@ func (n *NatsBucket) GetString(key string) (string, error) {
 	}
 	return string(entry.Value()), nil
 }
+
+func (n *NatsBucket) Get(key string) ([]byte, uint64, error) {
+	entry, err := n.kv.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry.Value(), entry.Revision(), nil
+}
+
+func (n *NatsBucket) Put(key string, value []byte) (uint64, error) {
+	return n.kv.Put(key, value)
+}
+
+func (n *NatsBucket) Create(key string, value []byte) (uint64, error) {
+	return n.kv.Create(key, value)
+}
+
+func (n *NatsBucket) Update(key string, value []byte, revision uint64) (uint64, error) {
+	return n.kv.Update(key, value, revision)
+}
+
+func (n *NatsBucket) Delete(key string) error {
+	return n.kv.Delete(key)
+}
+
+func (n *NatsBucket) Keys() ([]string, error) {
+	return n.kv.Keys()
+}
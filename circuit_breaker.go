@@ -0,0 +1,92 @@
+package dgnats
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	PublishCircuitBreaker = &CircuitBreakerConfig{}
+
+	circuitBreakers = sync.Map{}
+)
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `json:"failureThreshold" remark:"连续失败多少次后熔断, 0为不启用"`
+	OpenTimeout      time.Duration `json:"openTimeout" remark:"熔断后多久进入半开状态"`
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func getCircuitBreaker(category string) *circuitBreaker {
+	if PublishCircuitBreaker == nil || PublishCircuitBreaker.FailureThreshold <= 0 {
+		return nil
+	}
+
+	cb, _ := circuitBreakers.LoadOrStore(category, &circuitBreaker{})
+	return cb.(*circuitBreaker)
+}
+
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < PublishCircuitBreaker.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return nil
+	case circuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (cb *circuitBreaker) record(failed bool) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if !failed {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= PublishCircuitBreaker.FailureThreshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
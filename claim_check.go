@@ -0,0 +1,158 @@
+package dgnats
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	claimCheckBucketSuffix  = "claim-check"
+	claimCheckHeaderReserve = 4096
+)
+
+var (
+	ClaimCheckThreshold = 0
+
+	ErrClaimCheckNotFound = errors.New("claim check object not found")
+
+	claimCheckBucketCache = sync.Map{}
+)
+
+type claimCheckBucketEntry struct {
+	store nats.ObjectStore
+	ttl   time.Duration
+}
+
+func claimCheckMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
+	if msg.Header.Get(HeaderClaimCheck) != "" {
+		return nil
+	}
+	threshold := ClaimCheckThreshold
+	if threshold <= 0 {
+		threshold = int(maxPayload()) - claimCheckHeaderReserve
+	}
+	if len(msg.Data) <= threshold {
+		return nil
+	}
+
+	store, err := claimCheckStore(subject)
+	if err != nil {
+		dglogger.Errorf(ctx, "get claim check bucket of stream[%s] error: %v", subject.GetStream(), err)
+		return err
+	}
+	name := msg.Header.Get(nats.MsgIdHdr)
+	if name == "" {
+		name = nuid.Next()
+	}
+	if _, err = store.PutBytes(name, msg.Data); err != nil {
+		dglogger.Errorf(ctx, "put claim check object[%s] error: %v", name, err)
+		return err
+	}
+	dglogger.Infof(ctx, "offload subject[%s] message of %d bytes to claim check object[%s]", subject.GetSubject(), len(msg.Data), name)
+
+	msg.Header.Set(HeaderClaimCheck, claimCheckBucket(subject.GetStream())+"/"+name)
+	msg.Header.Set(HeaderClaimCheckSize, strconv.Itoa(len(msg.Data)))
+	msg.Data = nil
+
+	return nil
+}
+
+func inlineClaimCheck(msg *nats.Msg) error {
+	reference := msg.Header.Get(HeaderClaimCheck)
+	if reference == "" {
+		return nil
+	}
+	bucket, name, ok := strings.Cut(reference, "/")
+	if !ok {
+		return ErrClaimCheckNotFound
+	}
+
+	js, err := GetJs()
+	if err != nil {
+		return err
+	}
+	store, err := js.ObjectStore(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		return ErrClaimCheckNotFound
+	}
+	if err != nil {
+		return err
+	}
+	data, err := store.GetBytes(name)
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return ErrClaimCheckNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	msg.Data = data
+	msg.Header.Del(HeaderClaimCheck)
+	msg.Header.Del(HeaderClaimCheckSize)
+
+	return nil
+}
+
+func claimCheckStore(subject *NatsSubject) (nats.ObjectStore, error) {
+	bucket := claimCheckBucket(subject.GetStream())
+	ttl := utils.IfReturn(subject.MaxAge > 0, subject.MaxAge, defaultMaxAge)
+	if cached, ok := claimCheckBucketCache.Load(bucket); ok && cached.(*claimCheckBucketEntry).ttl >= ttl {
+		return cached.(*claimCheckBucketEntry).store, nil
+	}
+
+	js, err := GetJs()
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.ObjectStore(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+		store, err = js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:  bucket,
+			TTL:     ttl,
+			Storage: nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// subjects of a category share the bucket, so objects live as long as the longest lived subject
+	status, err := store.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status.TTL() < ttl {
+		streamInfo, err := js.StreamInfo("OBJ_" + bucket)
+		if err != nil {
+			return nil, err
+		}
+		streamInfo.Config.MaxAge = ttl
+		if _, err = js.UpdateStream(&streamInfo.Config); err != nil {
+			return nil, err
+		}
+	} else {
+		ttl = status.TTL()
+	}
+	claimCheckBucketCache.Store(bucket, &claimCheckBucketEntry{store: store, ttl: ttl})
+
+	return store, nil
+}
+
+func deleteClaimCheckBucket(js nats.JetStreamContext, stream string) {
+	bucket := claimCheckBucket(stream)
+	claimCheckBucketCache.Delete(bucket)
+	_ = js.DeleteObjectStore(bucket)
+}
+
+func claimCheckBucket(stream string) string {
+	return ReplaceIllegalCharacter(stream) + dash + claimCheckBucketSuffix
+}
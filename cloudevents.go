@@ -0,0 +1,226 @@
+package dgnats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	CloudEventsSpecVersion     = "1.0"
+	ContentTypeCloudEventsJson = "application/cloudevents+json"
+
+	HeaderCeId          = "ce-id"
+	HeaderCeSource      = "ce-source"
+	HeaderCeType        = "ce-type"
+	HeaderCeSpecVersion = "ce-specversion"
+	HeaderCeTime        = "ce-time"
+)
+
+var ErrInvalidCloudEvent = errors.New("invalid cloud event")
+
+type CloudEvent[T any] struct {
+	Id              string    `json:"id" remark:"事件id, 为空时自动生成, 同时作为消息去重id"`
+	Source          string    `json:"source" binding:"required" remark:"事件来源"`
+	Type            string    `json:"type" binding:"required" remark:"事件类型"`
+	SpecVersion     string    `json:"specversion" remark:"CloudEvents规范版本, 默认1.0"`
+	Time            time.Time `json:"time,omitzero" remark:"事件时间, 为空时取当前时间"`
+	DataContentType string    `json:"datacontenttype,omitempty" remark:"data的媒体类型, binary模式下由subject的codec决定, structured模式下仅支持json"`
+	TraceId         string    `json:"traceid,omitempty" remark:"链路追踪id扩展属性, 与TraceId header一致"`
+	Data            *T        `json:"data,omitempty" remark:"事件数据"`
+}
+
+type cloudEventEnvelope struct {
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	SpecVersion     string          `json:"specversion"`
+	Time            time.Time       `json:"time,omitzero"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	TraceId         string          `json:"traceid,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+func PublishCloudEvent[T any](ctx *dgctx.DgContext, subject *NatsSubject, event *CloudEvent[T], opts ...PublishOption) error {
+	if err := fillCloudEvent(ctx, event); err != nil {
+		dglogger.Errorf(ctx, "publish subject[%s] cloud event error: %v", subject.GetSubject(), err)
+		return err
+	}
+	codec, err := subject.codec()
+	if err != nil {
+		return err
+	}
+	if event.DataContentType != "" && event.DataContentType != codec.ContentType() {
+		err = fmt.Errorf("%w: datacontenttype %s does not match subject codec %s", ErrInvalidCloudEvent, event.DataContentType, codec.ContentType())
+		dglogger.Errorf(ctx, "publish subject[%s] cloud event error: %v", subject.GetSubject(), err)
+		return err
+	}
+	event.DataContentType = codec.ContentType()
+
+	header := nats.Header{
+		HeaderMsgId:         {event.Id},
+		HeaderCeId:          {event.Id},
+		HeaderCeSource:      {event.Source},
+		HeaderCeType:        {event.Type},
+		HeaderCeSpecVersion: {event.SpecVersion},
+		HeaderCeTime:        {event.Time.Format(time.RFC3339Nano)},
+	}
+
+	return PublishWithHeaders(ctx, subject, header, event.Data, opts...)
+}
+
+func PublishCloudEventStructured[T any](ctx *dgctx.DgContext, subject *NatsSubject, event *CloudEvent[T], opts ...PublishOption) error {
+	if err := fillCloudEvent(ctx, event); err != nil {
+		dglogger.Errorf(ctx, "publish subject[%s] cloud event error: %v", subject.GetSubject(), err)
+		return err
+	}
+	if event.DataContentType == "" {
+		event.DataContentType = ContentTypeJson
+	}
+	if event.DataContentType != ContentTypeJson {
+		err := fmt.Errorf("%w: structured mode only supports %s data", ErrInvalidCloudEvent, ContentTypeJson)
+		dglogger.Errorf(ctx, "publish subject[%s] cloud event error: %v", subject.GetSubject(), err)
+		return err
+	}
+
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		dglogger.Errorf(ctx, "json marshal cloud event error | err: %v", err)
+		return err
+	}
+	header := nats.Header{
+		HeaderMsgId:       {event.Id},
+		HeaderContentType: {ContentTypeCloudEventsJson},
+	}
+	_, err = publishRawWithHeader(ctx, subject, header, bytes, withPayloadLog("publish", opts))
+
+	return ignoreSpooled(err)
+}
+
+func SubscribeCloudEvent[T any](ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, *CloudEvent[T]) error) (*nats.Subscription, error) {
+	return subscribeMsg(ctx, subject, cloudEventWorkFn(JsonCodec, workFn))
+}
+
+func SubscribeCloudEventWithTag[T any](ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn func(*dgctx.DgContext, *CloudEvent[T]) error) (*nats.Subscription, error) {
+	return subscribeMsgWithTag(ctx, subject, tag, cloudEventWorkFn(JsonCodec, workFn))
+}
+
+func DecodeCloudEvent[T any](msg *nats.Msg) (*CloudEvent[T], error) {
+	return decodeCloudEvent[T](msg, JsonCodec)
+}
+
+func cloudEventWorkFn[T any](fallback Codec, workFn func(*dgctx.DgContext, *CloudEvent[T]) error) ConsumeHandler {
+	return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+		event, err := decodeCloudEvent[T](msg, fallback)
+		if err != nil {
+			dglogger.Errorf(ctx, "decode subject[%s] cloud event error: %v", msg.Subject, err)
+			return err
+		}
+		if msg.Header.Get(HeaderTraceId) == "" && event.TraceId != "" {
+			ctx.TraceId = event.TraceId
+		}
+
+		return workFn(ctx, event)
+	}
+}
+
+func fillCloudEvent[T any](ctx *dgctx.DgContext, event *CloudEvent[T]) error {
+	if event == nil || event.Source == "" || event.Type == "" {
+		return fmt.Errorf("%w: source and type are required", ErrInvalidCloudEvent)
+	}
+	if event.Id == "" {
+		event.Id = nuid.Next()
+	}
+	if event.SpecVersion == "" {
+		event.SpecVersion = CloudEventsSpecVersion
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.TraceId = ctx.TraceId
+
+	return nil
+}
+
+func decodeCloudEvent[T any](msg *nats.Msg, fallback Codec) (*CloudEvent[T], error) {
+	if strings.HasPrefix(msg.Header.Get(HeaderContentType), ContentTypeCloudEventsJson) {
+		return decodeStructuredCloudEvent[T](msg)
+	}
+
+	event := &CloudEvent[T]{
+		Id:              msg.Header.Get(HeaderCeId),
+		Source:          msg.Header.Get(HeaderCeSource),
+		Type:            msg.Header.Get(HeaderCeType),
+		SpecVersion:     msg.Header.Get(HeaderCeSpecVersion),
+		DataContentType: msg.Header.Get(HeaderContentType),
+		TraceId:         msg.Header.Get(HeaderTraceId),
+	}
+	if err := checkCloudEvent(event.Id, event.Source, event.Type, event.SpecVersion); err != nil {
+		return nil, err
+	}
+	if ceTime := msg.Header.Get(HeaderCeTime); ceTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, ceTime)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+		}
+		event.Time = t
+	}
+	if len(msg.Data) > 0 {
+		data, err := decodeMsg[T](msg, fallback)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = data
+	}
+
+	return event, nil
+}
+
+func decodeStructuredCloudEvent[T any](msg *nats.Msg) (*CloudEvent[T], error) {
+	envelope := &cloudEventEnvelope{}
+	if err := json.Unmarshal(msg.Data, envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+	}
+	if err := checkCloudEvent(envelope.Id, envelope.Source, envelope.Type, envelope.SpecVersion); err != nil {
+		return nil, err
+	}
+
+	event := &CloudEvent[T]{
+		Id:              envelope.Id,
+		Source:          envelope.Source,
+		Type:            envelope.Type,
+		SpecVersion:     envelope.SpecVersion,
+		Time:            envelope.Time,
+		DataContentType: envelope.DataContentType,
+		TraceId:         envelope.TraceId,
+	}
+	if event.TraceId == "" {
+		event.TraceId = msg.Header.Get(HeaderTraceId)
+	}
+	if len(envelope.Data) > 0 && string(envelope.Data) != "null" {
+		header := copyHeader(msg.Header)
+		header.Set(HeaderContentType, ContentTypeJson)
+		data, err := decodeMsg[T](&nats.Msg{Subject: msg.Subject, Header: header, Data: envelope.Data}, JsonCodec)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = data
+	}
+
+	return event, nil
+}
+
+func checkCloudEvent(id string, source string, eventType string, specVersion string) error {
+	if id == "" || source == "" || eventType == "" || specVersion == "" {
+		return fmt.Errorf("%w: id, source, type and specversion are required", ErrInvalidCloudEvent)
+	}
+
+	return nil
+}
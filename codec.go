@@ -0,0 +1,182 @@
+package dgnats
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJson     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeCbor     = "application/cbor"
+)
+
+var (
+	ErrUnknownCodec    = errors.New("unknown codec")
+	ErrNotProtoMessage = errors.New("value is not a proto.Message")
+
+	JsonCodec     Codec = jsonCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	CborCodec     Codec = cborCodec{}
+
+	codecs = map[string]Codec{
+		ContentTypeJson:     JsonCodec,
+		ContentTypeProtobuf: ProtobufCodec,
+		ContentTypeMsgpack:  MsgpackCodec,
+		ContentTypeCbor:     CborCodec,
+	}
+	defaultCodec = JsonCodec
+	codecMu      sync.RWMutex
+)
+
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+func RegisterCodec(codec Codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+func SetDefaultCodec(codec Codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+	defaultCodec = codec
+}
+
+func GetCodec(contentType string) (Codec, error) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+
+	if contentType == "" {
+		return defaultCodec, nil
+	}
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+
+	return codec, nil
+}
+
+func (s *NatsSubject) codec() (Codec, error) {
+	return GetCodec(s.Codec)
+}
+
+func decodeMsg[T any](msg *nats.Msg, fallback Codec) (*T, error) {
+	if len(msg.Data) == 0 {
+		return nil, nil
+	}
+	codec, err := resolveMsgCodec(msg, fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec.ContentType() == ContentTypeJson {
+		version, _ := strconv.Atoi(msg.Header.Get(HeaderSchemaVersion))
+		if _, err = validateSchema(msg.Subject, version, msg.Data); errors.Is(err, ErrSchemaValidation) || (err != nil && SchemaFailClosed) {
+			return nil, err
+		}
+	}
+
+	data, err := upcastMsg[T](msg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(T)
+	if err = codec.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func resolveMsgCodec(msg *nats.Msg, fallback Codec) (Codec, error) {
+	if contentType := msg.Header.Get(HeaderContentType); contentType != "" {
+		return GetCodec(contentType)
+	}
+
+	return fallback, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJson
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return ContentTypeCbor
+}
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	return cbor.Unmarshal(data, v)
+}
@@ -0,0 +1,124 @@
+package dgnats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionS2   = "s2"
+)
+
+var (
+	DefaultCompressThreshold = 1024
+
+	ErrUnknownCompression = errors.New("unknown compression")
+
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+)
+
+func compressMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
+	if subject.Compression == "" || msg.Header.Get(HeaderContentEncoding) != "" {
+		return nil
+	}
+	threshold := subject.CompressThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if len(msg.Data) < threshold {
+		return nil
+	}
+
+	compressed, err := compress(subject.Compression, msg.Data)
+	if err != nil {
+		dglogger.Errorf(ctx, "compress subject[%s] message with %s error: %v", subject.GetSubject(), subject.Compression, err)
+		return err
+	}
+	if len(compressed) >= len(msg.Data) {
+		return nil
+	}
+
+	msg.Data = compressed
+	msg.Header.Set(HeaderContentEncoding, subject.Compression)
+
+	return nil
+}
+
+func decompressMsg(msg *nats.Msg) error {
+	encoding := msg.Header.Get(HeaderContentEncoding)
+	if encoding == "" {
+		return nil
+	}
+
+	data, err := decompress(encoding, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	msg.Header.Del(HeaderContentEncoding)
+
+	return nil
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	case CompressionS2:
+		return s2.Encode(nil, data), nil
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		return io.ReadAll(r)
+	case CompressionZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	case CompressionS2:
+		return s2.Decode(nil, data)
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
@@ -3,20 +3,26 @@ package dgnats
 import (
 	"errors"
 	"math/rand"
+	"sync"
 	"time"
 
 	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
 	dglogger "github.com/darwinOrg/go-logger"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nuid"
 )
 
+const defaultMaxPayload = 1 << 20
+
 var (
 	natsConns             []*nats.Conn
 	natsJsMap             = map[*nats.Conn]nats.JetStreamContext{}
 	connectionFailedError = errors.New("connection failed")
 	noConnectionError     = errors.New("no connection")
 	connectWaitDuration   = time.Second * 3
+	natsNamespace         string
+	connMu                sync.RWMutex
 )
 
 type NatsConfig struct {
@@ -25,9 +31,17 @@ type NatsConfig struct {
 	ConnectionName string   `json:"connection-name" mapstructure:"connection-name"`
 	Username       string   `json:"username" mapstructure:"username"`
 	Password       string   `json:"password" mapstructure:"password"`
+	Namespace      string   `json:"namespace" mapstructure:"namespace"`
+	DelayScheduler bool     `json:"delay-scheduler" mapstructure:"delay-scheduler"`
+
+	PublishAsyncMaxPending int           `json:"publish-async-max-pending" mapstructure:"publish-async-max-pending"`
+	PublishAsyncTimeout    time.Duration `json:"publish-async-timeout" mapstructure:"publish-async-timeout"`
 }
 
 func Connect(natsConf *NatsConfig) error {
+	natsNamespace = natsConf.Namespace
+	initAsyncPending(natsConf.PublishAsyncMaxPending)
+
 	for i := 0; i < natsConf.PoolSize; i++ {
 		nc, err := connect(natsConf)
 		if err != nil {
@@ -43,6 +57,10 @@ func Connect(natsConf *NatsConfig) error {
 		}
 	}
 
+	if natsConf.DelayScheduler {
+		return StartDelayScheduler(nil, natsConf.Namespace)
+	}
+
 	return nil
 }
 
@@ -85,23 +103,36 @@ func connect(natsConf *NatsConfig) (*nats.Conn, error) {
 		return nil, err
 	}
 
-	js, err := nc.JetStream()
+	js, err := nc.JetStream(buildJsOpts(natsConf)...)
 	if err != nil {
 		return nil, err
 	}
 
+	connMu.Lock()
 	natsConns = append(natsConns, nc)
 	natsJsMap[nc] = js
+	connMu.Unlock()
 
 	return nc, nil
 }
 
+func buildJsOpts(natsConf *NatsConfig) []nats.JSOpt {
+	jsOpts := []nats.JSOpt{
+		nats.PublishAsyncMaxPending(utils.IfReturn(natsConf.PublishAsyncMaxPending > 0, natsConf.PublishAsyncMaxPending, defaultPublishAsyncMaxPending)),
+		nats.PublishAsyncTimeout(utils.IfReturn(natsConf.PublishAsyncTimeout > 0, natsConf.PublishAsyncTimeout, defaultPublishAsyncTimeout)),
+	}
+
+	return jsOpts
+}
+
 func getConn() (*nats.Conn, error) {
+	connMu.RLock()
 	if len(natsConns) == 0 {
+		connMu.RUnlock()
 		return nil, noConnectionError
 	}
-
 	nc := natsConns[rand.Int()%len(natsConns)]
+	connMu.RUnlock()
 
 	if nc.Status() != nats.CONNECTED {
 		time.Sleep(connectWaitDuration)
@@ -114,12 +145,28 @@ func getConn() (*nats.Conn, error) {
 	return nc, nil
 }
 
+func maxPayload() int64 {
+	connMu.RLock()
+	defer connMu.RUnlock()
+
+	if len(natsConns) > 0 {
+		if mp := natsConns[0].MaxPayload(); mp > 0 {
+			return mp
+		}
+	}
+
+	return defaultMaxPayload
+}
+
 func GetJs() (nats.JetStreamContext, error) {
 	nc, err := getConn()
 	if err != nil {
 		return nil, err
 	}
 
+	connMu.RLock()
+	defer connMu.RUnlock()
+
 	return natsJsMap[nc], nil
 }
 
@@ -133,9 +180,21 @@ func Flush(timeout time.Duration) error {
 }
 
 func Close() {
+	stopDelaySchedulers()
+	closeSpool()
+
+	connMu.Lock()
+	defer connMu.Unlock()
+
 	for _, nc := range natsConns {
 		if nc != nil && !nc.IsClosed() {
 			nc.Close()
 		}
 	}
+	natsConns = nil
+	natsJsMap = map[*nats.Conn]nats.JetStreamContext{}
+	claimCheckBucketCache.Range(func(key, value any) bool {
+		claimCheckBucketCache.Delete(key)
+		return true
+	})
 }
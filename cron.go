@@ -0,0 +1,313 @@
+package dgnats
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	CronMissedFireSkip = "skip"
+	CronMissedFireOnce = "fire-once"
+	CronMissedFireAll  = "fire-all"
+
+	cronBucket         = "dgnats-cron"
+	cronLeaderBucket   = "dgnats-cron-leader"
+	cronLeaderKey      = "leader"
+	cronScheduleKey    = "schedule."
+	cronStateKey       = "state."
+	cronMaxMissedFires = 100
+)
+
+var (
+	CronTick      = time.Second
+	CronLeaseTTL  = 10 * time.Second
+	CronLookahead = time.Minute
+
+	ErrCronScheduleNotFound = errors.New("cron schedule not found")
+
+	cronNameRegex = regexp.MustCompile(`^[-_a-zA-Z0-9]+$`)
+)
+
+type CronSchedule struct {
+	Name       string       `json:"name" binding:"required" remark:"任务名"`
+	Spec       string       `json:"spec" binding:"required" remark:"cron表达式, 5位标准格式或@every/@daily等"`
+	Timezone   string       `json:"timezone" remark:"时区, 如Asia/Shanghai, 默认UTC"`
+	MissedFire string       `json:"missedFire" remark:"错过触发的策略: skip/fire-once/fire-all, 默认skip"`
+	Subject    *NatsSubject `json:"subject" binding:"required" remark:"投递的subject"`
+	Data       []byte       `json:"data" remark:"消息内容"`
+}
+
+type cronState struct {
+	LastScheduled time.Time `json:"lastScheduled"`
+}
+
+type cronScheduler struct {
+	instanceId string
+	schedules  *NatsBucket
+	leader     *NatsBucket
+	stopCh     chan struct{}
+	stopOnce   sync.Once
+}
+
+func RegisterCronSchedule(ctx *dgctx.DgContext, schedule *CronSchedule) error {
+	if !cronNameRegex.MatchString(schedule.Name) {
+		return errors.New("invalid cron schedule name: " + schedule.Name)
+	}
+	if _, err := parseCronSchedule(schedule); err != nil {
+		return err
+	}
+	if err := schedule.Subject.validatePublish(); err != nil {
+		return err
+	}
+
+	bucket, err := NewNatsBucket(cronBucket)
+	if err != nil {
+		return err
+	}
+	value, err := utils.ConvertBeanToJsonString(schedule)
+	if err != nil {
+		return err
+	}
+	if _, err = bucket.Put(cronScheduleKey+schedule.Name, []byte(value)); err != nil {
+		dglogger.Errorf(ctx, "register cron schedule[%s] error: %v", schedule.Name, err)
+		return err
+	}
+	dglogger.Infof(ctx, "register cron schedule[%s]: %s", schedule.Name, schedule.Spec)
+
+	return nil
+}
+
+func RemoveCronSchedule(ctx *dgctx.DgContext, name string) error {
+	bucket, err := NewNatsBucket(cronBucket)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = bucket.Get(cronScheduleKey + name); errors.Is(err, nats.ErrKeyNotFound) {
+		return ErrCronScheduleNotFound
+	}
+	if err = bucket.Delete(cronScheduleKey + name); err != nil {
+		dglogger.Errorf(ctx, "remove cron schedule[%s] error: %v", name, err)
+		return err
+	}
+	_ = bucket.Delete(cronStateKey + name)
+
+	return nil
+}
+
+func ListCronSchedules(ctx *dgctx.DgContext) ([]*CronSchedule, error) {
+	bucket, err := NewNatsBucket(cronBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadCronSchedules(ctx, bucket)
+}
+
+func StartCronScheduler(ctx *dgctx.DgContext) (stop func(), err error) {
+	if ctx == nil {
+		ctx = dgctx.SimpleDgContext()
+	}
+
+	schedules, err := NewNatsBucket(cronBucket)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := NewNatsBucketWithConfig("", &nats.KeyValueConfig{Bucket: cronLeaderBucket, TTL: CronLeaseTTL})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cronScheduler{
+		instanceId: nuid.Next(),
+		schedules:  schedules,
+		leader:     leader,
+		stopCh:     make(chan struct{}),
+	}
+	go s.run(ctx)
+
+	return func() {
+		s.stopOnce.Do(func() { close(s.stopCh) })
+	}, nil
+}
+
+func (s *cronScheduler) run(ctx *dgctx.DgContext) {
+	ticker := time.NewTicker(CronTick)
+	defer ticker.Stop()
+
+	for {
+		if s.elect(ctx) {
+			s.tick(ctx, time.Now())
+		}
+
+		select {
+		case <-s.stopCh:
+			s.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *cronScheduler) elect(ctx *dgctx.DgContext) bool {
+	value, revision, err := s.leader.Get(cronLeaderKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		if _, err = s.leader.Create(cronLeaderKey, []byte(s.instanceId)); err == nil {
+			dglogger.Infof(ctx, "cron scheduler[%s] elected as leader", s.instanceId)
+			return true
+		}
+		return false
+	}
+	if err != nil || string(value) != s.instanceId {
+		return false
+	}
+
+	_, err = s.leader.Update(cronLeaderKey, []byte(s.instanceId), revision)
+	return err == nil
+}
+
+func (s *cronScheduler) resign() {
+	value, _, err := s.leader.Get(cronLeaderKey)
+	if err == nil && string(value) == s.instanceId {
+		_ = s.leader.Delete(cronLeaderKey)
+	}
+}
+
+func (s *cronScheduler) tick(ctx *dgctx.DgContext, now time.Time) {
+	schedules, err := loadCronSchedules(ctx, s.schedules)
+	if err != nil {
+		dglogger.Errorf(ctx, "load cron schedules error: %v", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if err := s.fire(ctx, schedule, now); err != nil {
+			dglogger.Errorf(ctx, "fire cron schedule[%s] error: %v", schedule.Name, err)
+		}
+	}
+}
+
+func (s *cronScheduler) fire(ctx *dgctx.DgContext, schedule *CronSchedule, now time.Time) error {
+	parsed, err := parseCronSchedule(schedule)
+	if err != nil {
+		return err
+	}
+
+	state := &cronState{LastScheduled: now}
+	value, revision, err := s.schedules.Get(cronStateKey + schedule.Name)
+	if err == nil {
+		if state, err = utils.ConvertJsonStringToBean[cronState](string(value)); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, nats.ErrKeyNotFound) {
+		return err
+	}
+	lastScheduled := state.LastScheduled
+
+	var missed []time.Time
+	next := parsed.Next(lastScheduled)
+	for ; next.Before(now); next = parsed.Next(next) {
+		if len(missed) < cronMaxMissedFires {
+			missed = append(missed, next)
+		}
+		lastScheduled = next
+	}
+	switch {
+	case len(missed) == 0:
+	case schedule.MissedFire == CronMissedFireAll:
+	case schedule.MissedFire == CronMissedFireOnce:
+		missed = missed[len(missed)-1:]
+	default:
+		missed = nil
+	}
+	for _, fireAt := range missed {
+		dglogger.Infof(ctx, "fire missed cron schedule[%s] at %s", schedule.Name, fireAt.Format(time.RFC3339))
+		if err = PublishRaw(ctx, schedule.Subject, schedule.Data, WithMsgId(cronMsgId(schedule, fireAt))); err != nil {
+			return err
+		}
+	}
+
+	if !next.After(now.Add(CronLookahead)) {
+		if err = startDelayScheduler(ctx, schedule.Subject.GetNamespace()); err != nil {
+			return err
+		}
+	}
+	for ; !next.After(now.Add(CronLookahead)); next = parsed.Next(next) {
+		if _, err = PublishAt(ctx, schedule.Subject, schedule.Data, next, WithMsgId(cronMsgId(schedule, next))); err != nil {
+			return err
+		}
+		lastScheduled = next
+	}
+
+	if lastScheduled.Equal(state.LastScheduled) && revision > 0 {
+		return nil
+	}
+	stateJson, err := utils.ConvertBeanToJsonString(&cronState{LastScheduled: lastScheduled})
+	if err != nil {
+		return err
+	}
+	if revision > 0 {
+		_, err = s.schedules.Update(cronStateKey+schedule.Name, []byte(stateJson), revision)
+	} else {
+		_, err = s.schedules.Create(cronStateKey+schedule.Name, []byte(stateJson))
+	}
+
+	return err
+}
+
+func loadCronSchedules(ctx *dgctx.DgContext, bucket *NatsBucket) ([]*CronSchedule, error) {
+	keys, err := bucket.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []*CronSchedule
+	for _, key := range keys {
+		if !strings.HasPrefix(key, cronScheduleKey) {
+			continue
+		}
+
+		value, _, err := bucket.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		schedule, err := utils.ConvertJsonStringToBean[CronSchedule](string(value))
+		if err != nil {
+			dglogger.Errorf(ctx, "decode cron schedule[%s] error: %v", key, err)
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+func parseCronSchedule(schedule *CronSchedule) (cron.Schedule, error) {
+	spec := schedule.Spec
+	if !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = "CRON_TZ=" + utils.IfReturn(schedule.Timezone != "", schedule.Timezone, "UTC") + " " + spec
+	}
+
+	return cron.ParseStandard(spec)
+}
+
+func cronMsgId(schedule *CronSchedule, fireAt time.Time) string {
+	return "cron-" + schedule.Name + "-" + strconv.FormatInt(fireAt.Unix(), 10)
+}
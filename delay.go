@@ -0,0 +1,614 @@
+package dgnats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darwinOrg/go-common/constants"
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	delayCategory      = "dgnats-delay"
+	delaySubjectPrefix = "dgnats.delay"
+	delayConsumer      = "dgnats-delay-scheduler"
+	delayParkMsgId     = "delay-park-"
+	delayBucketSize    = time.Minute
+
+	natsExpectedHdrPrefix = "Nats-Expected-"
+)
+
+var (
+	DelaySchedulerTick       = 100 * time.Millisecond
+	DelaySchedulerSlots      = 600
+	DelaySchedulerMaxPending = 100000
+	DelaySchedulerRetryWait  = 5 * time.Second
+
+	ErrDelayNotFound = errors.New("delay message not found")
+
+	delayStreamCache = sync.Map{}
+	delaySchedulers  = sync.Map{}
+	delaySchedulerMu = sync.Mutex{}
+)
+
+type DelayInfo struct {
+	Id       string    `json:"id" remark:"延迟消息id"`
+	Subject  string    `json:"subject" remark:"目标subject"`
+	DueAt    time.Time `json:"dueAt" remark:"到期时间"`
+	Sequence uint64    `json:"sequence" remark:"延迟流中的序号"`
+	Data     []byte    `json:"data" remark:"消息内容"`
+}
+
+type delayScheduler struct {
+	namespace string
+	sub       *nats.Subscription
+	wheel     *timerWheel
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+}
+
+func StartDelayScheduler(ctx *dgctx.DgContext, namespace string) error {
+	if ctx == nil {
+		ctx = dgctx.SimpleDgContext()
+	}
+
+	return startDelayScheduler(ctx, resolveNamespace(namespace))
+}
+
+func startDelayScheduler(ctx *dgctx.DgContext, namespace string) error {
+	delaySchedulerMu.Lock()
+	defer delaySchedulerMu.Unlock()
+
+	if _, ok := delaySchedulers.Load(namespace); ok {
+		return nil
+	}
+
+	js, err := ensureDelayStream(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	wheel := newTimerWheel(DelaySchedulerTick, DelaySchedulerSlots)
+	sub, err := js.PullSubscribe(withNamespace(namespace, delaySubjectPrefix, dot)+".>", delayConsumer,
+		nats.BindStream(withNamespace(namespace, delayCategory, dash)),
+		nats.AckExplicit(),
+		nats.AckWait(wheel.horizon()+30*time.Second),
+		nats.MaxDeliver(-1),
+		nats.MaxAckPending(DelaySchedulerMaxPending),
+	)
+	if err != nil {
+		wheel.stop()
+		dglogger.Errorf(ctx, "subscribe delay stream error: %v", err)
+		return err
+	}
+
+	scheduler := &delayScheduler{
+		namespace: namespace,
+		sub:       sub,
+		wheel:     wheel,
+		stopCh:    make(chan struct{}),
+	}
+	scheduler.wg.Add(2)
+	go scheduler.run()
+	go scheduler.sweepLoop()
+	delaySchedulers.Store(namespace, scheduler)
+
+	return nil
+}
+
+func stopDelaySchedulers() {
+	delaySchedulerMu.Lock()
+	defer delaySchedulerMu.Unlock()
+
+	delaySchedulers.Range(func(key, value any) bool {
+		scheduler := value.(*delayScheduler)
+		close(scheduler.stopCh)
+		scheduler.wg.Wait()
+		scheduler.wheel.stop()
+		delaySchedulers.Delete(key)
+		return true
+	})
+	delayStreamCache.Range(func(key, value any) bool {
+		delayStreamCache.Delete(key)
+		return true
+	})
+}
+
+func publishDelayMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, dueAt time.Time, opts *publishOptions) (string, *nats.PubAck, error) {
+	err := subject.validatePublish()
+	if err != nil {
+		dglogger.Errorf(ctx, "validate publish subject error: %v", err)
+		return "", nil, err
+	}
+	if opts.hasExpectation() {
+		return "", nil, ErrDelayExpectationUnsupported
+	}
+
+	pinned := subject.InNamespace(subject.GetNamespace())
+	subjectJson, err := utils.ConvertBeanToJsonString(pinned)
+	if err != nil {
+		return "", nil, err
+	}
+	resolveMsgId(msg, opts)
+	if opts.payloadLogAction != "" {
+		logPayload(ctx, opts.payloadLogAction, subject, msg)
+	}
+	if err = encodeMsg(ctx, subject, msg); err != nil {
+		return "", nil, err
+	}
+	if opts.ttl > 0 {
+		msg.Header.Set(HeaderDelayTTL, opts.ttl.String())
+	}
+	msg.Header.Set(HeaderDelaySubject, subjectJson)
+	msg.Header.Set(HeaderDueAt, strconv.FormatInt(dueAt.UnixNano(), 10))
+
+	// derive the token from the msg id so a deduplicated publish returns the handle of the stored original
+	token := delayToken(msg.Header.Get(nats.MsgIdHdr))
+	delaySubject := buildDelaySubject(pinned, token, dueAt)
+	msg.Subject = delaySubject.GetSubject()
+
+	js, err := ensureDelayStream(ctx, pinned.GetNamespace())
+	if err != nil {
+		return "", nil, err
+	}
+
+	ack, err := sendMsg(ctx, js, delaySubject, msg, opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return withNamespace(pinned.GetNamespace(), token, dot), ack, checkDuplicate(ctx, subject, msg, ack, opts)
+}
+
+func CancelDelay(ctx *dgctx.DgContext, id string) error {
+	js, stream, raw, err := findDelay(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, token := parseDelayId(id)
+	err = js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: withDelayBucket(raw.Subject, token, "*")})
+	if err != nil {
+		dglogger.Errorf(ctx, "cancel delay[%s] error: %v", id, err)
+		return err
+	}
+	dglogger.Infof(ctx, "cancel delay[%s]", id)
+
+	return nil
+}
+
+func RescheduleDelay(ctx *dgctx.DgContext, id string, dueAt time.Time) error {
+	js, stream, raw, err := findDelay(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	header := raw.Header
+	pubAt, _ := strconv.ParseInt(header.Get(HeaderPubAt), 10, 64)
+	header.Set(HeaderDueAt, strconv.FormatInt(dueAt.UnixNano(), 10))
+	header.Set(HeaderDelay, strconv.FormatInt(dueAt.UnixNano()-pubAt, 10))
+	preserveDelayMsgId(header)
+	header.Set(nats.MsgIdHdr, nuid.Next())
+
+	_, token := parseDelayId(id)
+	delaySubject := withDelayBucket(raw.Subject, token, delayBucket(dueAt))
+	_, err = js.PublishMsg(&nats.Msg{Subject: delaySubject, Header: header, Data: raw.Data}, nats.ExpectStream(stream))
+	if err != nil {
+		dglogger.Errorf(ctx, "reschedule delay[%s] error: %v", id, err)
+		return err
+	}
+	if delaySubject != raw.Subject {
+		if err = js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: raw.Subject}); err != nil {
+			dglogger.Errorf(ctx, "purge rescheduled delay[%s] error: %v", id, err)
+			return err
+		}
+	}
+	dglogger.Infof(ctx, "reschedule delay[%s] to %s", id, dueAt.Format(time.RFC3339))
+
+	return nil
+}
+
+func ListPendingDelays(ctx *dgctx.DgContext, subject *NatsSubject) ([]*DelayInfo, error) {
+	js, err := GetJs()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := subject.GetNamespace()
+	stream := withNamespace(namespace, delayCategory, dash)
+	prefix := withNamespace(namespace, delaySubjectPrefix, dot) + dot
+	streamInfo, err := js.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: prefix + "*.*" + dot + subject.GetSubject()})
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var delays []*DelayInfo
+	for delaySubject := range streamInfo.State.Subjects {
+		raw, err := js.GetLastMsg(stream, delaySubject)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			dglogger.Errorf(ctx, "get delay message[%s] error: %v", delaySubject, err)
+			return nil, err
+		}
+
+		dueAt, _ := strconv.ParseInt(raw.Header.Get(HeaderDueAt), 10, 64)
+		token := strings.SplitN(strings.TrimPrefix(delaySubject, prefix), dot, 3)[1]
+		delays = append(delays, &DelayInfo{
+			Id:       withNamespace(namespace, token, dot),
+			Subject:  subject.GetSubject(),
+			DueAt:    time.Unix(0, dueAt),
+			Sequence: raw.Sequence,
+			Data:     raw.Data,
+		})
+	}
+	sort.Slice(delays, func(i, j int) bool {
+		return delays[i].DueAt.Before(delays[j].DueAt)
+	})
+
+	return delays, nil
+}
+
+func findDelay(ctx *dgctx.DgContext, id string) (nats.JetStreamContext, string, *nats.RawStreamMsg, error) {
+	js, err := GetJs()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	namespace, token := parseDelayId(id)
+	if token == "" || strings.ContainsAny(token, "*> ") {
+		return nil, "", nil, ErrDelayNotFound
+	}
+
+	stream := withNamespace(namespace, delayCategory, dash)
+	filter := withNamespace(namespace, delaySubjectPrefix, dot) + ".*." + token + ".>"
+	streamInfo, err := js.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: filter})
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil, "", nil, ErrDelayNotFound
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	for delaySubject := range streamInfo.State.Subjects {
+		raw, err := js.GetLastMsg(stream, delaySubject)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			break
+		}
+		if err != nil {
+			dglogger.Errorf(ctx, "get delay message[%s] error: %v", delaySubject, err)
+		}
+		return js, stream, raw, err
+	}
+
+	return nil, "", nil, ErrDelayNotFound
+}
+
+func parseDelayId(id string) (string, string) {
+	if i := strings.LastIndex(id, dot); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+
+	return "", id
+}
+
+func delayToken(msgId string) string {
+	sum := sha256.Sum256([]byte(msgId))
+	return hex.EncodeToString(sum[:12])
+}
+
+func buildDelaySubject(pinned *NatsSubject, token string, dueAt time.Time) *NatsSubject {
+	return &NatsSubject{
+		Namespace: pinned.Namespace,
+		Category:  delayCategory,
+		Name:      delaySubjectPrefix + dot + delayBucket(dueAt) + dot + token + dot + pinned.GetSubject(),
+	}
+}
+
+func delayBucket(dueAt time.Time) string {
+	return strconv.FormatInt(dueAt.UnixNano()/int64(delayBucketSize), 10)
+}
+
+func withDelayBucket(delaySubject string, token string, bucket string) string {
+	i := strings.Index(delaySubject, dot+token+dot)
+	j := strings.LastIndex(delaySubject[:i], dot)
+
+	return delaySubject[:j+1] + bucket + delaySubject[i:]
+}
+
+func ensureDelayStream(ctx *dgctx.DgContext, namespace string) (nats.JetStreamContext, error) {
+	js, err := GetJs()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := delayStreamCache.Load(namespace); ok {
+		return js, nil
+	}
+
+	stream := withNamespace(namespace, delayCategory, dash)
+	_, err = js.StreamInfo(stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		dglogger.Debugf(ctx, "add delay stream %s", stream)
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:              stream,
+			Subjects:          []string{withNamespace(namespace, delaySubjectPrefix, dot) + ".>"},
+			Storage:           nats.FileStorage,
+			MaxMsgsPerSubject: 1,
+		})
+		if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) && !strings.Contains(err.Error(), "existing") {
+			dglogger.Errorf(ctx, "add delay stream[%s] error: %v", stream, err)
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	delayStreamCache.Store(namespace, true)
+
+	return js, nil
+}
+
+func (s *delayScheduler) run() {
+	defer s.wg.Done()
+
+	ctx := &dgctx.DgContext{TraceId: nuid.Next()}
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		msgs, err := s.sub.Fetch(100, nats.MaxWait(time.Second))
+		if err != nil {
+			if !errors.Is(err, nats.ErrTimeout) {
+				dglogger.Errorf(ctx, "fetch delay messages error: %v", err)
+				select {
+				case <-s.stopCh:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+
+		for _, msg := range msgs {
+			s.schedule(msg)
+		}
+	}
+}
+
+func (s *delayScheduler) schedule(msg *nats.Msg) {
+	ctx := buildDgContextFromMsg(msg)
+	dueAtNano, err := strconv.ParseInt(msg.Header.Get(HeaderDueAt), 10, 64)
+	if err != nil {
+		dglogger.Errorf(ctx, "drop delay message without due time: %s", msg.Subject)
+		s.remove(ctx, msg)
+		_ = msg.Term()
+		return
+	}
+
+	// park far-future messages in the stream instead of holding them in ack pending,
+	// sweep republishes them once they are within the wheel horizon
+	dueAt := time.Unix(0, dueAtNano)
+	if time.Until(dueAt) > s.wheel.horizon() {
+		if err := msg.Ack(); err != nil {
+			dglogger.Errorf(ctx, "msg.Ack error: %v", err)
+		}
+		return
+	}
+
+	s.wheel.add(dueAt, func() {
+		s.fire(ctx, msg)
+	})
+}
+
+func (s *delayScheduler) fire(ctx *dgctx.DgContext, msg *nats.Msg) {
+	if !s.isCurrent(ctx, msg) {
+		dglogger.Debugf(ctx, "skip canceled or rescheduled delay message: %s", msg.Subject)
+		_ = msg.Ack()
+		return
+	}
+
+	subject, err := utils.ConvertJsonStringToBean[NatsSubject](msg.Header.Get(HeaderDelaySubject))
+	if err != nil {
+		dglogger.Errorf(ctx, "drop delay message with bad subject: %v", err)
+		s.remove(ctx, msg)
+		_ = msg.Term()
+		return
+	}
+
+	header := nats.Header{}
+	for key, values := range msg.Header {
+		switch key {
+		case HeaderDelaySubject, HeaderDueAt, HeaderDelayMsgId, nats.MsgIdHdr:
+		case HeaderDelayTTL:
+			header[nats.MsgTTLHdr] = values
+		default:
+			if !strings.HasPrefix(key, natsExpectedHdrPrefix) {
+				header[key] = values
+			}
+		}
+	}
+	if header.Get(constants.TraceId) == "" {
+		header.Set(constants.TraceId, ctx.TraceId)
+	}
+
+	target := &nats.Msg{
+		Subject: subject.GetSubject(),
+		Header:  header,
+		Data:    msg.Data,
+	}
+	_, err = sendPublishMsg(ctx, subject, target, buildPublishOptions([]PublishOption{WithMsgId(delayMsgId(msg.Header))}))
+	if err = ignoreSpooled(err); err != nil {
+		dglogger.Errorf(ctx, "publish due delay message to subject[%s] error: %v", subject.GetSubject(), err)
+		_ = msg.NakWithDelay(DelaySchedulerRetryWait)
+		return
+	}
+
+	s.remove(ctx, msg)
+	if err := msg.AckSync(); err != nil {
+		dglogger.Errorf(ctx, "msg.AckSync error: %v", err)
+	}
+}
+
+func (s *delayScheduler) remove(ctx *dgctx.DgContext, msg *nats.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return
+	}
+	js, err := GetJs()
+	if err != nil {
+		return
+	}
+	if err = js.DeleteMsg(meta.Stream, meta.Sequence.Stream); err != nil && !errors.Is(err, nats.ErrMsgNotFound) {
+		dglogger.Errorf(ctx, "delete delay message[%s] error: %v", msg.Subject, err)
+	}
+}
+
+func (s *delayScheduler) isCurrent(ctx *dgctx.DgContext, msg *nats.Msg) bool {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return true
+	}
+
+	js, err := GetJs()
+	if err != nil {
+		return true
+	}
+	raw, err := js.GetLastMsg(meta.Stream, msg.Subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return false
+	}
+	if err != nil {
+		dglogger.Warnf(ctx, "get delay message[%s] error: %v", msg.Subject, err)
+		return true
+	}
+
+	return raw.Sequence == meta.Sequence.Stream
+}
+
+func (s *delayScheduler) sweepLoop() {
+	defer s.wg.Done()
+
+	ctx := &dgctx.DgContext{TraceId: nuid.Next()}
+	prefix := withNamespace(s.namespace, delaySubjectPrefix, dot)
+	horizon := s.wheel.horizon()
+
+	// scan the whole stream once to catch up on messages that came due while no scheduler ran,
+	// afterwards only the due time buckets entering the wheel horizon are scanned
+	s.sweep(ctx, prefix+".>")
+	next := time.Now().Add(horizon).UnixNano() / int64(delayBucketSize)
+
+	ticker := time.NewTicker(horizon / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			last := time.Now().Add(horizon).UnixNano() / int64(delayBucketSize)
+			for bucket := next; bucket <= last; bucket++ {
+				s.sweep(ctx, prefix+dot+strconv.FormatInt(bucket, 10)+".>")
+			}
+			next = last
+		}
+	}
+}
+
+func (s *delayScheduler) sweep(ctx *dgctx.DgContext, filter string) {
+	js, err := GetJs()
+	if err != nil {
+		return
+	}
+	stream := withNamespace(s.namespace, delayCategory, dash)
+	sub, err := js.SubscribeSync(filter, nats.BindStream(stream), nats.OrderedConsumer(), nats.HeadersOnly(), nats.DeliverAll())
+	if err != nil {
+		dglogger.Errorf(ctx, "subscribe delay stream for sweep error: %v", err)
+		return
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	// skip empty buckets instead of waiting for NextMsg to time out
+	if info, err := sub.ConsumerInfo(); err == nil && info.NumPending == 0 && info.Delivered.Consumer == 0 {
+		return
+	}
+
+	horizon := s.wheel.horizon()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			if !errors.Is(err, nats.ErrTimeout) {
+				dglogger.Errorf(ctx, "sweep delay stream error: %v", err)
+			}
+			return
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return
+		}
+
+		dueAtNano, _ := strconv.ParseInt(msg.Header.Get(HeaderDueAt), 10, 64)
+		dueAt := time.Unix(0, dueAtNano)
+		// only messages that were parked when written, near ones are already on a wheel
+		if dueAt.Sub(meta.Timestamp) > horizon && time.Until(dueAt) <= horizon {
+			s.unpark(ctx, js, meta)
+		}
+		if meta.NumPending == 0 {
+			return
+		}
+	}
+}
+
+func (s *delayScheduler) unpark(ctx *dgctx.DgContext, js nats.JetStreamContext, meta *nats.MsgMetadata) {
+	raw, err := js.GetMsg(meta.Stream, meta.Sequence.Stream)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return
+	}
+	if err != nil {
+		dglogger.Errorf(ctx, "get parked delay message[%d] error: %v", meta.Sequence.Stream, err)
+		return
+	}
+
+	header := raw.Header
+	preserveDelayMsgId(header)
+	header.Set(nats.MsgIdHdr, delayParkMsgId+strconv.FormatUint(raw.Sequence, 10))
+	// the expected sequence keeps canceled or rescheduled messages from being revived
+	_, err = js.PublishMsg(&nats.Msg{Subject: raw.Subject, Header: header, Data: raw.Data},
+		nats.ExpectStream(meta.Stream), nats.ExpectLastSequencePerSubject(raw.Sequence))
+	if err != nil && !errors.Is(wrapWrongLastSequence(err), ErrWrongLastSequence) {
+		dglogger.Errorf(ctx, "unpark delay message[%s] error: %v", raw.Subject, err)
+	}
+}
+
+func preserveDelayMsgId(header nats.Header) {
+	if header.Get(HeaderDelayMsgId) == "" {
+		header.Set(HeaderDelayMsgId, header.Get(nats.MsgIdHdr))
+	}
+}
+
+func delayMsgId(header nats.Header) string {
+	if msgId := header.Get(HeaderDelayMsgId); msgId != "" {
+		return msgId
+	}
+
+	return header.Get(nats.MsgIdHdr)
+}
@@ -0,0 +1,276 @@
+package dgnats
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	EncryptionAes256Gcm = "AES-256-GCM"
+
+	dataKeySize = 32
+)
+
+var (
+	ErrNoKeyProvider          = errors.New("no key provider")
+	ErrUnknownKeyId           = errors.New("unknown key id")
+	ErrInvalidKeySize         = errors.New("key must be 32 bytes")
+	ErrUnsupportedEncryption  = errors.New("unsupported encryption algorithm")
+	ErrDecryptionFailed       = errors.New("decryption failed")
+	errMalformedEncryptedData = errors.New("malformed encrypted data")
+
+	natsEncryption atomic.Pointer[EncryptionConfig]
+)
+
+type KeyProvider interface {
+	CurrentKeyId() string
+	WrapKey(keyId string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyId string, wrappedKey []byte) ([]byte, error)
+}
+
+type EncryptionConfig struct {
+	KeyProvider       KeyProvider  `json:"-" binding:"required" remark:"主密钥提供者"`
+	QuarantineSubject *NatsSubject `json:"quarantineSubject" remark:"无法解密的消息转投的subject, 为空时直接丢弃"`
+}
+
+type StaticKeyProvider struct {
+	mu           sync.RWMutex
+	currentKeyId string
+	keys         map[string][]byte
+}
+
+func EnableEncryption(conf *EncryptionConfig) error {
+	if conf == nil || conf.KeyProvider == nil {
+		return ErrNoKeyProvider
+	}
+	natsEncryption.Store(conf)
+
+	return nil
+}
+
+func NewStaticKeyProvider(currentKeyId string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{keys: map[string][]byte{}}
+	for keyId, key := range keys {
+		if len(key) != dataKeySize {
+			return nil, ErrInvalidKeySize
+		}
+		p.keys[keyId] = key
+	}
+	if _, ok := p.keys[currentKeyId]; !ok {
+		return nil, ErrUnknownKeyId
+	}
+	p.currentKeyId = currentKeyId
+
+	return p, nil
+}
+
+func (p *StaticKeyProvider) Rotate(keyId string, key []byte) error {
+	if len(key) != dataKeySize {
+		return ErrInvalidKeySize
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys[keyId] = key
+	p.currentKeyId = keyId
+
+	return nil
+}
+
+func (p *StaticKeyProvider) CurrentKeyId() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.currentKeyId
+}
+
+func (p *StaticKeyProvider) WrapKey(keyId string, dataKey []byte) ([]byte, error) {
+	key, err := p.key(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealData(key, dataKey, []byte(keyId))
+}
+
+func (p *StaticKeyProvider) UnwrapKey(keyId string, wrappedKey []byte) ([]byte, error) {
+	key, err := p.key(keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	return openData(key, wrappedKey, []byte(keyId))
+}
+
+func (p *StaticKeyProvider) key(keyId string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	key, ok := p.keys[keyId]
+	if !ok {
+		return nil, ErrUnknownKeyId
+	}
+
+	return key, nil
+}
+
+func encryptMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
+	if !subject.Encrypt || msg.Header.Get(HeaderEncryption) != "" {
+		return nil
+	}
+	conf := natsEncryption.Load()
+	if conf == nil {
+		dglogger.Errorf(ctx, "encrypt subject[%s] message error: %v", subject.GetSubject(), ErrNoKeyProvider)
+		return ErrNoKeyProvider
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	keyId := conf.KeyProvider.CurrentKeyId()
+	wrappedKey, err := conf.KeyProvider.WrapKey(keyId, dataKey)
+	if err != nil {
+		dglogger.Errorf(ctx, "wrap data key with key[%s] error: %v", keyId, err)
+		return err
+	}
+	data, err := sealData(dataKey, msg.Data, []byte(keyId))
+	if err != nil {
+		return err
+	}
+
+	msg.Data = data
+	msg.Header.Set(HeaderEncryption, EncryptionAes256Gcm)
+	msg.Header.Set(HeaderEncryptionKeyId, keyId)
+	msg.Header.Set(HeaderEncryptionDataKey, base64.StdEncoding.EncodeToString(wrappedKey))
+
+	return nil
+}
+
+func decryptMsg(msg *nats.Msg) error {
+	algorithm := msg.Header.Get(HeaderEncryption)
+	if algorithm == "" {
+		return nil
+	}
+	if algorithm != EncryptionAes256Gcm {
+		return ErrUnsupportedEncryption
+	}
+	conf := natsEncryption.Load()
+	if conf == nil {
+		return ErrNoKeyProvider
+	}
+
+	keyId := msg.Header.Get(HeaderEncryptionKeyId)
+	wrappedKey, err := base64.StdEncoding.DecodeString(msg.Header.Get(HeaderEncryptionDataKey))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedEncryptedData, err)
+	}
+	dataKey, err := conf.KeyProvider.UnwrapKey(keyId, wrappedKey)
+	if err != nil {
+		return err
+	}
+	data, err := openData(dataKey, msg.Data, []byte(keyId))
+	if err != nil {
+		return err
+	}
+
+	msg.Data = data
+	msg.Header.Del(HeaderEncryption)
+	msg.Header.Del(HeaderEncryptionKeyId)
+	msg.Header.Del(HeaderEncryptionDataKey)
+
+	return nil
+}
+
+func isUndecryptableMsg(err error) bool {
+	return errors.Is(err, ErrUnknownKeyId) || errors.Is(err, ErrDecryptionFailed) ||
+		errors.Is(err, ErrUnsupportedEncryption) || errors.Is(err, errMalformedEncryptedData)
+}
+
+func quarantineMsg(ctx *dgctx.DgContext, msg *nats.Msg, cause error) {
+	conf := natsEncryption.Load()
+	if conf == nil || conf.QuarantineSubject == nil {
+		dglogger.Errorf(ctx, "drop undecryptable subject[%s] message: %v", msg.Subject, cause)
+		_ = msg.Term()
+		return
+	}
+
+	header := nats.Header{}
+	for key, values := range msg.Header {
+		if key != nats.MsgIdHdr {
+			header[key] = values
+		}
+	}
+	header.Set(HeaderQuarantineSubject, msg.Subject)
+	header.Set(HeaderQuarantineError, cause.Error())
+
+	var opts []PublishOption
+	if meta, err := msg.Metadata(); err == nil {
+		opts = append(opts, WithMsgId("quarantine-"+meta.Stream+"-"+strconv.FormatUint(meta.Sequence.Stream, 10)))
+	}
+	quarantine := &nats.Msg{
+		Subject: conf.QuarantineSubject.GetSubject(),
+		Header:  header,
+		Data:    msg.Data,
+	}
+	if _, err := publishMsg(ctx, conf.QuarantineSubject, quarantine, buildPublishOptions(opts)); err != nil {
+		dglogger.Errorf(ctx, "quarantine subject[%s] message error: %v", msg.Subject, err)
+		_ = msg.NakWithDelay(SubWorkErrorRetryWait)
+		return
+	}
+
+	dglogger.Warnf(ctx, "quarantine undecryptable subject[%s] message to [%s]: %v", msg.Subject, quarantine.Subject, cause)
+	_ = msg.Term()
+}
+
+func sealData(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openData(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errMalformedEncryptedData
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+
+	return plaintext, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -1,7 +1,34 @@
 package dgnats
 
+import (
+	"github.com/darwinOrg/go-common/constants"
+	"github.com/nats-io/nats.go"
+)
+
 const (
-	headerDelay = "delay"
-	headerPubAt = "pub-at"
-	headerTag   = "tag"
+	HeaderTraceId = constants.TraceId
+	HeaderMsgId   = nats.MsgIdHdr
+
+	HeaderDelay = "delay"
+	HeaderPubAt = "pub-at"
+	HeaderTag   = "tag"
+
+	HeaderContentType     = "content-type"
+	HeaderContentEncoding = "content-encoding"
+	HeaderSchemaVersion   = "schema-version"
+	HeaderMsgVersion      = "msg-version"
+
+	HeaderEncryption        = "enc-alg"
+	HeaderEncryptionKeyId   = "enc-key-id"
+	HeaderEncryptionDataKey = "enc-data-key"
+	HeaderQuarantineSubject = "quarantine-subject"
+	HeaderQuarantineError   = "quarantine-error"
+
+	HeaderClaimCheck     = "claim-check"
+	HeaderClaimCheckSize = "claim-check-size"
+
+	HeaderDelaySubject = "delay-subject"
+	HeaderDueAt        = "due-at"
+	HeaderDelayTTL     = "delay-ttl"
+	HeaderDelayMsgId   = "delay-msg-id"
 )
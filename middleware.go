@@ -0,0 +1,88 @@
+package dgnats
+
+import (
+	"sync"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/nats-io/nats.go"
+)
+
+type PublishHandler func(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) (*nats.PubAck, error)
+
+type PublishMiddleware func(next PublishHandler) PublishHandler
+
+type ConsumeHandler func(ctx *dgctx.DgContext, msg *nats.Msg) error
+
+type ConsumeMiddleware func(next ConsumeHandler) ConsumeHandler
+
+var (
+	publishMiddlewares        []PublishMiddleware
+	consumeMiddlewares        []ConsumeMiddleware
+	subjectPublishMiddlewares subjectRegistry[PublishMiddleware]
+	subjectConsumeMiddlewares subjectRegistry[ConsumeMiddleware]
+	middlewareMu              sync.RWMutex
+)
+
+func UsePublishMiddleware(middlewares ...PublishMiddleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	publishMiddlewares = append(publishMiddlewares, middlewares...)
+}
+
+func UseConsumeMiddleware(middlewares ...ConsumeMiddleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	consumeMiddlewares = append(consumeMiddlewares, middlewares...)
+}
+
+func UseSubjectPublishMiddleware(subject *NatsSubject, middlewares ...PublishMiddleware) {
+	pinned := *subject
+	subjectPublishMiddlewares.add(subject.Namespace+"|"+subject.Name, pinned.GetSubject, middlewares...)
+}
+
+func UseSubjectConsumeMiddleware(subject *NatsSubject, middlewares ...ConsumeMiddleware) {
+	pinned := *subject
+	subjectConsumeMiddlewares.add(subject.Namespace+"|"+subject.Name, pinned.GetSubject, middlewares...)
+}
+
+func ResetMiddlewares() {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	publishMiddlewares = nil
+	consumeMiddlewares = nil
+	subjectPublishMiddlewares.reset()
+	subjectConsumeMiddlewares.reset()
+}
+
+func chainPublish(subject *NatsSubject, handler PublishHandler) PublishHandler {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+
+	subjectMiddlewares := subjectPublishMiddlewares.lookup(subject.GetSubject(), subjectMatches)
+	for i := len(subjectMiddlewares) - 1; i >= 0; i-- {
+		handler = subjectMiddlewares[i](handler)
+	}
+	for i := len(publishMiddlewares) - 1; i >= 0; i-- {
+		handler = publishMiddlewares[i](handler)
+	}
+
+	return handler
+}
+
+func chainConsume(subject string, handler ConsumeHandler) ConsumeHandler {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+
+	subjectMiddlewares := subjectConsumeMiddlewares.lookup(subject, subjectMatches)
+	for i := len(subjectMiddlewares) - 1; i >= 0; i-- {
+		handler = subjectMiddlewares[i](handler)
+	}
+	for i := len(consumeMiddlewares) - 1; i >= 0; i-- {
+		handler = consumeMiddlewares[i](handler)
+	}
+
+	return handler
+}
@@ -1,8 +1,16 @@
 package dgnats_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -72,7 +80,7 @@ func TestPubSub(t *testing.T) {
 		return
 	}
 
-	err = dgnats.PublishDelay(ctx, testDelaySubject, &TestStruct{Content: "456"}, time.Second*3)
+	_, err = dgnats.PublishDelay(ctx, testDelaySubject, &TestStruct{Content: "456"}, time.Second*3)
 	if err != nil {
 		dglogger.Errorf(ctx, "publish delay message error: %v", err)
 		return
@@ -119,3 +127,1656 @@ func TestDeleteAllStream(t *testing.T) {
 		_ = js.DeleteStream(stream.Config.Name)
 	}
 }
+
+func TestNamespace(t *testing.T) {
+	subject := &dgnats.NatsSubject{
+		Namespace: "dev",
+		Category:  "order",
+		Name:      "order.created",
+		Group:     "group",
+	}
+
+	if subject.GetStream() != "dev-order" {
+		t.Errorf("unexpected stream: %s", subject.GetStream())
+	}
+	if subject.GetSubject() != "dev.order.created" {
+		t.Errorf("unexpected subject: %s", subject.GetSubject())
+	}
+	if subject.GetQueue() != "dev-group" {
+		t.Errorf("unexpected queue: %s", subject.GetQueue())
+	}
+	if subject.GetDurable("tag") != "dev-order-order-created-group-tag" {
+		t.Errorf("unexpected durable: %s", subject.GetDurable("tag"))
+	}
+
+	global := subject.InNamespace("")
+	if global.GetStream() != "order" || global.GetSubject() != "order.created" {
+		t.Errorf("unexpected global subject: %s %s", global.GetStream(), global.GetSubject())
+	}
+}
+
+func connectTest(t *testing.T) {
+	connectTestInNamespace(t, "")
+}
+
+func connectTestInNamespace(t *testing.T, namespace string) {
+	err := dgnats.Connect(&dgnats.NatsConfig{
+		PoolSize:       1,
+		Servers:        []string{nats.DefaultURL},
+		ConnectionName: "startrek_mq",
+		Username:       "startrek_mq",
+		Password:       "cswjggljrmpypwfccarzpjxG-urepqldkhecvnzxzmngotaqs-bkwdvjgipruectqcowoqb6nj",
+		Namespace:      namespace,
+	})
+	if err != nil {
+		t.Fatalf("connect nats error: %v", err)
+	}
+	t.Cleanup(dgnats.Close)
+}
+
+func TestRemoveSubject(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	retired := &dgnats.NatsSubject{Category: "test-remove", Name: "test-remove.retired", Group: "group"}
+	kept := &dgnats.NatsSubject{Category: "test-remove", Name: "test-remove.kept"}
+	_ = dgnats.Publish(ctx, kept, "kept")
+	_ = dgnats.Publish(ctx, retired, "retired")
+	_, _ = dgnats.Subscribe(ctx, retired, func(ctx *dgctx.DgContext, bytes []byte) error {
+		return nil
+	})
+
+	err := dgnats.RemoveSubject(ctx, retired, true)
+	if err != nil {
+		t.Fatalf("remove subject error: %v", err)
+	}
+
+	js, _ := dgnats.GetJs()
+	si, err := js.StreamInfo(retired.GetStream())
+	if err != nil {
+		t.Fatalf("stream info error: %v", err)
+	}
+	if len(si.Config.Subjects) != 1 || si.Config.Subjects[0] != kept.GetSubject() {
+		t.Errorf("unexpected subjects: %v", si.Config.Subjects)
+	}
+	if si.State.Msgs != 1 || si.State.Consumers != 0 {
+		t.Errorf("unexpected state: %+v", si.State)
+	}
+
+	// another process removes the cached subject
+	_ = dgnats.Publish(ctx, kept, "cached")
+	si.Config.Subjects = []string{"test-remove.other"}
+	if _, err = js.UpdateStream(&si.Config); err != nil {
+		t.Fatalf("update stream error: %v", err)
+	}
+	if err = dgnats.Publish(ctx, kept, "kept again"); err != nil {
+		t.Fatalf("publish after external removal error: %v", err)
+	}
+	if si, err = js.StreamInfo(kept.GetStream()); err != nil || !slices.Contains(si.Config.Subjects, kept.GetSubject()) {
+		t.Errorf("expected subject to be restored: %v %v", si, err)
+	}
+
+	_ = dgnats.DeleteStream(ctx, kept)
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		subject *dgnats.NatsSubject
+		err     error
+	}{
+		{&dgnats.NatsSubject{Category: "order", Name: "order.created", Group: "group"}, nil},
+		{&dgnats.NatsSubject{Category: "order", Name: "order.*"}, nil},
+		{&dgnats.NatsSubject{Name: "order.created"}, dgnats.ErrInvalidStreamName},
+		{&dgnats.NatsSubject{Category: "order.v1", Name: "order.created"}, dgnats.ErrInvalidStreamName},
+		{&dgnats.NatsSubject{Category: "order", Name: ""}, dgnats.ErrInvalidSubjectName},
+		{&dgnats.NatsSubject{Category: "order", Name: "order created"}, dgnats.ErrInvalidSubjectName},
+		{&dgnats.NatsSubject{Category: "order", Name: "order..created"}, dgnats.ErrInvalidSubjectName},
+		{&dgnats.NatsSubject{Category: "order", Name: "order.>.created"}, dgnats.ErrInvalidSubjectName},
+		{&dgnats.NatsSubject{Category: "order", Name: "order.created", Group: "my group"}, dgnats.ErrInvalidQueueName},
+		{&dgnats.NatsSubject{Namespace: "dev.1", Category: "order", Name: "order.created"}, dgnats.ErrInvalidStreamName},
+	}
+
+	for _, c := range cases {
+		err := c.subject.Validate()
+		if !errors.Is(err, c.err) || (c.err == nil && err != nil) {
+			t.Errorf("validate %+v: expected %v, got %v", c.subject, c.err, err)
+		}
+
+		var validationError *dgnats.SubjectValidationError
+		if c.err != nil && !errors.As(err, &validationError) {
+			t.Errorf("validate %+v: expected SubjectValidationError, got %T", c.subject, err)
+		}
+	}
+}
+
+func TestPublishDuplicate(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-dedup", Name: "test-dedup", DuplicateWindow: time.Minute}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	err := dgnats.Publish(ctx, subject, &TestStruct{Content: "123"}, dgnats.WithMsgId("order-1"))
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	err = dgnats.Publish(ctx, subject, &TestStruct{Content: "123"}, dgnats.WithMsgId("order-1"), dgnats.WithFailOnDuplicate())
+	if !errors.Is(err, dgnats.ErrDuplicateMessage) {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+
+	err = dgnats.Publish(ctx, subject, &TestStruct{Content: "456"}, dgnats.WithPayloadMsgId(), dgnats.WithFailOnDuplicate())
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	err = dgnats.Publish(ctx, subject, &TestStruct{Content: "456"}, dgnats.WithPayloadMsgId(), dgnats.WithFailOnDuplicate())
+	if !errors.Is(err, dgnats.ErrDuplicateMessage) {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestPublishWithAck(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-ack", Name: "test-ack"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	first, err := dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "123"})
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	second, err := dgnats.PublishRawWithAck(ctx, subject, []byte("456"))
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	if first.Stream != subject.GetStream() || second.Sequence != first.Sequence+1 || second.Duplicate {
+		t.Errorf("unexpected acks: %+v %+v", first, second)
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-async", Name: "test-async"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	var futures []*dgnats.PublishFuture
+	for i := 0; i < 100; i++ {
+		future, err := dgnats.PublishAsync(ctx, subject, &TestStruct{Content: "123"})
+		if err != nil {
+			t.Fatalf("publish async error: %v", err)
+		}
+		futures = append(futures, future)
+	}
+
+	waitCtx, cancel := dgctx.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dgnats.WaitAllAcks(waitCtx); err != nil {
+		t.Fatalf("wait all acks error: %v", err)
+	}
+
+	for _, future := range futures {
+		if ack, err := future.Ack(); err != nil || ack.Stream != subject.GetStream() {
+			t.Errorf("unexpected ack: %+v %v", ack, err)
+		}
+	}
+	if err := dgnats.WaitAllAcks(nil); err != nil {
+		t.Errorf("wait all acks with nil context error: %v", err)
+	}
+}
+
+func TestIsRetryablePublishError(t *testing.T) {
+	if !dgnats.IsRetryablePublishError(nats.ErrTimeout) || !dgnats.IsRetryablePublishError(nats.ErrNoResponders) ||
+		!dgnats.IsRetryablePublishError(nats.ErrNoStreamResponse) {
+		t.Errorf("expected transient errors to be retryable")
+	}
+	if dgnats.IsRetryablePublishError(dgnats.ErrDuplicateMessage) || dgnats.IsRetryablePublishError(dgnats.ErrInvalidSubjectName) {
+		t.Errorf("expected permanent errors not to be retryable")
+	}
+}
+
+func addFullStream(t *testing.T, subject *dgnats.NatsSubject, maxAge time.Duration) {
+	js, _ := dgnats.GetJs()
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     subject.GetStream(),
+		Subjects: []string{subject.GetSubject()},
+		MaxMsgs:  1,
+		MaxAge:   maxAge,
+		Discard:  nats.DiscardNew,
+	})
+	if err != nil {
+		t.Fatalf("add stream error: %v", err)
+	}
+}
+
+func TestPublishRetryBackoff(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-retry", Name: "test-retry"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+	addFullStream(t, subject, 500*time.Millisecond)
+	if err := dgnats.Publish(ctx, subject, "first"); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	attempts := 0
+	policy := &dgnats.RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     200 * time.Millisecond,
+		Multiplier:     2,
+		Retryable: func(err error) bool {
+			attempts++
+			return true
+		},
+	}
+	start := time.Now()
+	if err := dgnats.Publish(ctx, subject, "second", dgnats.WithRetryPolicy(policy)); err != nil {
+		t.Fatalf("publish with retry error: %v", err)
+	}
+	if elapsed := time.Since(start); attempts < 2 || elapsed < 300*time.Millisecond {
+		t.Errorf("expected backoff retries until the stream had room: %d attempts in %v", attempts, elapsed)
+	}
+
+	attempts = 0
+	policy.MaxAttempts = 3
+	if err := dgnats.Publish(ctx, subject, "third", dgnats.WithRetryPolicy(policy)); err == nil || attempts != 3 {
+		t.Errorf("expected failure after 3 attempts, got %d attempts: %v", attempts, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	breaker := dgnats.PublishCircuitBreaker
+	dgnats.PublishCircuitBreaker = &dgnats.CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: 200 * time.Millisecond}
+	defer func() { dgnats.PublishCircuitBreaker = breaker }()
+
+	subject := &dgnats.NatsSubject{Category: "test-breaker", Name: "test-breaker"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+	addFullStream(t, subject, time.Second)
+
+	noRetry := dgnats.WithRetryPolicy(&dgnats.RetryPolicy{MaxAttempts: 1, Retryable: func(error) bool { return true }})
+	publish := func() error {
+		return dgnats.Publish(ctx, subject, "data", noRetry)
+	}
+	if err := publish(); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	filled := time.Now()
+
+	// closed -> open after consecutive failures
+	for i := 0; i < 2; i++ {
+		if err := publish(); err == nil || errors.Is(err, dgnats.ErrCircuitOpen) {
+			t.Fatalf("expected stream full error, got %v", err)
+		}
+	}
+	if err := publish(); !errors.Is(err, dgnats.ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+
+	// open -> half open -> open when the probe fails
+	time.Sleep(250 * time.Millisecond)
+	if err := publish(); err == nil || errors.Is(err, dgnats.ErrCircuitOpen) {
+		t.Fatalf("expected half open probe to fail on full stream, got %v", err)
+	}
+	if err := publish(); !errors.Is(err, dgnats.ErrCircuitOpen) {
+		t.Fatalf("expected circuit to reopen after failed probe, got %v", err)
+	}
+
+	// open -> half open -> closed when the probe succeeds once the message expired
+	var err error
+	for err = errors.New("not probed"); err != nil && time.Since(filled) < 5*time.Second; {
+		time.Sleep(250 * time.Millisecond)
+		err = publish()
+	}
+	if err != nil {
+		t.Fatalf("expected half open probe to succeed, got %v", err)
+	}
+	if err = publish(); err == nil || errors.Is(err, dgnats.ErrCircuitOpen) {
+		t.Errorf("expected closed circuit to pass the publish through, got %v", err)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+
+	err := dgnats.EnableSpool(&dgnats.SpoolConfig{Dir: t.TempDir(), ForwardInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("enable spool error: %v", err)
+	}
+
+	subject := &dgnats.NatsSubject{Category: "test-spool", Name: "test-spool"}
+	err = dgnats.Publish(ctx, subject, &TestStruct{Content: "123"})
+	if err != nil || dgnats.GetSpoolStats().Spooled != 1 {
+		t.Fatalf("expected message to be spooled: %v %+v", err, dgnats.GetSpoolStats())
+	}
+	ack, err := dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "456"})
+	if ack != nil || !errors.Is(err, dgnats.ErrSpooled) {
+		t.Fatalf("expected spooled error without ack: %v %v", ack, err)
+	}
+
+	connectTest(t)
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	// live publishes queue behind the spool until it has drained
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "789"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	for i := 0; i < 30 && dgnats.GetSpoolStats().Forwarded < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	stats := dgnats.GetSpoolStats()
+	if stats.Spooled != 3 || stats.Forwarded != 3 || stats.PendingBytes != 0 {
+		t.Errorf("unexpected spool stats: %+v", stats)
+	}
+
+	js, _ := dgnats.GetJs()
+	for i, content := range []string{"123", "456", "789"} {
+		raw, err := js.GetMsg(subject.GetStream(), uint64(i+1))
+		if err != nil || !strings.Contains(string(raw.Data), content) {
+			t.Errorf("expected message %d to be %s: %v", i+1, content, err)
+		}
+	}
+}
+
+func TestSpoolTornTail(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	dir := t.TempDir()
+
+	if err := dgnats.EnableSpool(&dgnats.SpoolConfig{Dir: dir, ForwardInterval: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("enable spool error: %v", err)
+	}
+	subject := &dgnats.NatsSubject{Category: "test-spool-torn", Name: "test-spool-torn"}
+	for i := 0; i < 2; i++ {
+		if err := dgnats.Publish(ctx, subject, &TestStruct{Content: "123"}); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+	}
+	dgnats.Close()
+
+	// simulate a crash in the middle of writing a record
+	wal, err := os.OpenFile(dir+"/spool.wal", os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open spool error: %v", err)
+	}
+	_, _ = wal.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2})
+	_ = wal.Close()
+
+	if err = dgnats.EnableSpool(&dgnats.SpoolConfig{Dir: dir, ForwardInterval: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("enable spool error: %v", err)
+	}
+	connectTest(t)
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	for i := 0; i < 30 && dgnats.GetSpoolStats().Forwarded < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	stats := dgnats.GetSpoolStats()
+	if stats.Forwarded != 2 || stats.Dropped != 0 || stats.PendingBytes != 0 {
+		t.Errorf("unexpected spool stats after torn tail: %+v", stats)
+	}
+}
+
+func TestPublishLongDelay(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	tick, slots := dgnats.DelaySchedulerTick, dgnats.DelaySchedulerSlots
+	dgnats.DelaySchedulerTick, dgnats.DelaySchedulerSlots = 50*time.Millisecond, 10
+	defer func() { dgnats.DelaySchedulerTick, dgnats.DelaySchedulerSlots = tick, slots }()
+
+	subject := &dgnats.NatsSubject{Namespace: "test-ns", Category: "test-delay", Name: "test-delay", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteStream("test-ns-dgnats-delay")
+	}()
+
+	received := make(chan time.Time, 1)
+	_, err := dgnats.SubscribeDelay(ctx, subject, time.Second, func(ctx *dgctx.DgContext, bytes []byte) error {
+		received <- time.Now()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe delay error: %v", err)
+	}
+
+	start := time.Now()
+	_, err = dgnats.PublishDelay(ctx, subject, &TestStruct{Content: "456"}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("publish delay error: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if info, err := js.ConsumerInfo("test-ns-dgnats-delay", "dgnats-delay-scheduler"); err != nil || info.NumAckPending != 0 {
+		t.Errorf("expected parked delay not to be ack pending: %+v %v", info, err)
+	}
+
+	select {
+	case at := <-received:
+		if elapsed := at.Sub(start); elapsed < 2*time.Second || elapsed > 3*time.Second {
+			t.Errorf("unexpected delay: %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("delay message not received")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if info, err := js.StreamInfo("test-ns-dgnats-delay"); err != nil || info.State.Msgs != 0 {
+		t.Errorf("expected delivered delay to be removed: %+v %v", info, err)
+	}
+}
+
+func TestDelaySchedulerLifecycle(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Namespace: "test-ns3", Category: "test-delay", Name: "test-delay", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteStream("test-ns3-dgnats-delay")
+	}()
+
+	if _, err := dgnats.PublishDelay(ctx, subject, []byte("due"), 300*time.Millisecond); err != nil {
+		t.Fatalf("publish delay error: %v", err)
+	}
+	if _, err := js.ConsumerInfo("test-ns3-dgnats-delay", "dgnats-delay-scheduler"); !errors.Is(err, nats.ErrConsumerNotFound) {
+		t.Fatalf("expected publishing not to start a delay scheduler, got %v", err)
+	}
+
+	received := make(chan string, 1)
+	_, err := dgnats.Subscribe(ctx, subject, func(ctx *dgctx.DgContext, bytes []byte) error {
+		received <- string(bytes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if err = dgnats.StartDelayScheduler(ctx, "test-ns3"); err != nil {
+		t.Fatalf("start delay scheduler error: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		if data != "due" {
+			t.Errorf("unexpected data: %s", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("delay message not received after starting the scheduler")
+	}
+}
+
+func TestCancelAndRescheduleDelay(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Namespace: "test-ns2", Category: "test-delay", Name: "test-delay", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteStream("test-ns2-dgnats-delay")
+	}()
+
+	received := make(chan string, 2)
+	_, err := dgnats.SubscribeJsonDelay(ctx, subject, time.Second, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		received <- ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe delay error: %v", err)
+	}
+
+	canceled, _ := dgnats.PublishDelay(ctx, subject, &TestStruct{Content: "canceled"}, time.Second)
+	rescheduled, _ := dgnats.PublishAt(ctx, subject, &TestStruct{Content: "rescheduled"}, time.Now().Add(time.Hour))
+
+	delays, err := dgnats.ListPendingDelays(ctx, subject)
+	if err != nil || len(delays) != 2 || delays[0].Id != canceled || delays[1].Id != rescheduled {
+		t.Fatalf("unexpected pending delays: %+v %v", delays, err)
+	}
+
+	deduplicated, err := dgnats.PublishDelay(ctx, subject, &TestStruct{Content: "deduplicated"}, time.Second, dgnats.WithMsgId("dedup"))
+	if err != nil {
+		t.Fatalf("publish delay error: %v", err)
+	}
+	if again, err := dgnats.PublishDelay(ctx, subject, &TestStruct{Content: "deduplicated"}, time.Second, dgnats.WithMsgId("dedup")); err != nil || again != deduplicated {
+		t.Fatalf("expected deduplicated delay to return the original handle, got %s %v", again, err)
+	}
+	if err = dgnats.CancelDelay(ctx, deduplicated); err != nil {
+		t.Fatalf("cancel deduplicated delay error: %v", err)
+	}
+	if err = dgnats.CancelDelay(ctx, canceled); err != nil {
+		t.Fatalf("cancel delay error: %v", err)
+	}
+	if err = dgnats.RescheduleDelay(ctx, rescheduled, time.Now().Add(1500*time.Millisecond)); err != nil {
+		t.Fatalf("reschedule delay error: %v", err)
+	}
+	if err = dgnats.CancelDelay(ctx, canceled); !errors.Is(err, dgnats.ErrDelayNotFound) {
+		t.Errorf("expected delay not found, got %v", err)
+	}
+
+	select {
+	case content := <-received:
+		if content != "rescheduled" {
+			t.Errorf("unexpected content: %s", content)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("rescheduled message not received")
+	}
+
+	select {
+	case content := <-received:
+		t.Errorf("unexpected message: %s", content)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if delays, err = dgnats.ListPendingDelays(ctx, subject); err != nil || len(delays) != 0 {
+		t.Errorf("expected no pending delays after delivery, got %+v %v", delays, err)
+	}
+	if err = dgnats.CancelDelay(ctx, rescheduled); !errors.Is(err, dgnats.ErrDelayNotFound) {
+		t.Errorf("expected delivered delay not found, got %v", err)
+	}
+	if err = dgnats.RescheduleDelay(ctx, rescheduled, time.Now()); !errors.Is(err, dgnats.ErrDelayNotFound) {
+		t.Errorf("expected delivered delay not found, got %v", err)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Namespace: "test-cron", Category: "test-cron", Name: "test-cron", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteStream("test-cron-dgnats-delay")
+		_ = js.DeleteKeyValue("dgnats-cron")
+		_ = js.DeleteKeyValue("dgnats-cron-leader")
+	}()
+
+	err := dgnats.RegisterCronSchedule(ctx, &dgnats.CronSchedule{Name: "bad", Spec: "not a spec", Subject: subject})
+	if err == nil {
+		t.Fatal("expected invalid spec error")
+	}
+
+	err = dgnats.RegisterCronSchedule(ctx, &dgnats.CronSchedule{
+		Name:     "every-second",
+		Spec:     "@every 1s",
+		Timezone: "Asia/Shanghai",
+		Subject:  subject,
+		Data:     []byte("tick"),
+	})
+	if err != nil {
+		t.Fatalf("register cron schedule error: %v", err)
+	}
+	schedules, err := dgnats.ListCronSchedules(ctx)
+	if err != nil || len(schedules) != 1 || schedules[0].Name != "every-second" {
+		t.Fatalf("unexpected schedules: %v, %v", schedules, err)
+	}
+
+	received := make(chan string, 100)
+	_, err = dgnats.Subscribe(ctx, subject, func(ctx *dgctx.DgContext, bytes []byte) error {
+		received <- string(bytes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	stop1, err := dgnats.StartCronScheduler(ctx)
+	if err != nil {
+		t.Fatalf("start cron scheduler error: %v", err)
+	}
+	defer stop1()
+	stop2, err := dgnats.StartCronScheduler(ctx)
+	if err != nil {
+		t.Fatalf("start cron scheduler error: %v", err)
+	}
+	defer stop2()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			if data != "tick" {
+				t.Errorf("unexpected data: %s", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected cron fire %d", i+1)
+		}
+	}
+	time.Sleep(time.Second)
+	if fired := 2 + len(received); fired > int(time.Since(start).Seconds())+2 {
+		t.Errorf("cron fired %d times in %v", fired, time.Since(start))
+	}
+
+	if err = dgnats.RemoveCronSchedule(ctx, "every-second"); err != nil {
+		t.Errorf("remove cron schedule error: %v", err)
+	}
+	if err = dgnats.RemoveCronSchedule(ctx, "every-second"); !errors.Is(err, dgnats.ErrCronScheduleNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	// lookahead and missed fires of the same time share one msg id
+	msgId := dgnats.WithMsgId("cron-dedup")
+	if _, err = dgnats.PublishAt(ctx, subject, []byte("dup"), time.Now().Add(300*time.Millisecond), msgId); err != nil {
+		t.Fatalf("publish at error: %v", err)
+	}
+	if err = dgnats.PublishRaw(ctx, subject, []byte("dup"), msgId); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	dups := 0
+	for len(received) > 0 {
+		if <-received == "dup" {
+			dups++
+		}
+	}
+	if dups != 1 {
+		t.Errorf("expected one delivery for the same fire, got %d", dups)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-codec", Name: "test-codec", Group: "group", Codec: dgnats.ContentTypeMsgpack}
+	jsonSubject := &dgnats.NatsSubject{Category: "test-codec", Name: "test-codec", Group: "group-json"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	received := make(chan string, 2)
+	_, err := dgnats.SubscribeTyped(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		if ts == nil {
+			received <- "typed:nil"
+			return nil
+		}
+		received <- "typed:" + ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	_, err = dgnats.SubscribeJson(ctx, jsonSubject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		if ts == nil {
+			received <- "json:nil"
+			return nil
+		}
+		received <- "json:" + ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "msgpack"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if err = dgnats.PublishRaw(ctx, subject, nil); err != nil {
+		t.Fatalf("publish empty error: %v", err)
+	}
+
+	got := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case s := <-received:
+			got[s] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected message, got %v", got)
+		}
+	}
+	if !got["typed:msgpack"] || !got["json:msgpack"] || !got["typed:nil"] || !got["json:nil"] {
+		t.Errorf("unexpected messages: %v", got)
+	}
+
+	if _, err = dgnats.GetCodec("application/unknown"); !errors.Is(err, dgnats.ErrUnknownCodec) {
+		t.Errorf("expected unknown codec error, got %v", err)
+	}
+	if err = dgnats.Publish(ctx, &dgnats.NatsSubject{Category: "test-codec", Name: "test-codec", Codec: dgnats.ContentTypeProtobuf}, &TestStruct{}); !errors.Is(err, dgnats.ErrNotProtoMessage) {
+		t.Errorf("expected not proto message error, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, &dgnats.NatsSubject{Category: "test-compression", Name: "test-gzip"})
+	}()
+
+	large := &TestStruct{Content: strings.Repeat("analytics-event ", 512)}
+	for _, compression := range []string{dgnats.CompressionGzip, dgnats.CompressionZstd, dgnats.CompressionS2} {
+		subject := &dgnats.NatsSubject{Category: "test-compression", Name: "test-" + compression, Group: compression, Compression: compression}
+
+		received := make(chan string, 2)
+		_, err := dgnats.SubscribeJson(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+			received <- ts.Content
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("subscribe error: %v", err)
+		}
+
+		if err = dgnats.Publish(ctx, subject, large); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+		raw, err := js.GetLastMsg(subject.GetStream(), subject.GetSubject())
+		if err != nil {
+			t.Fatalf("get last msg error: %v", err)
+		}
+		if raw.Header.Get("content-encoding") != compression || len(raw.Data) >= len(large.Content) {
+			t.Errorf("expected %s compressed message, got %q with %d bytes", compression, raw.Header.Get("content-encoding"), len(raw.Data))
+		}
+
+		if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "small"}); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+		raw, _ = js.GetLastMsg(subject.GetStream(), subject.GetSubject())
+		if raw.Header.Get("content-encoding") != "" {
+			t.Errorf("expected small message uncompressed")
+		}
+
+		for _, expected := range []string{large.Content, "small"} {
+			select {
+			case content := <-received:
+				if content != expected {
+					t.Errorf("%s: unexpected content length %d", compression, len(content))
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("%s: expected message", compression)
+			}
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-encryption", Name: "test-encryption", Group: "group", Encrypt: true}
+	lost := &dgnats.NatsSubject{Category: "test-encryption", Name: "test-encryption-lost", Group: "group", Encrypt: true}
+	quarantine := &dgnats.NatsSubject{Category: "test-encryption", Name: "test-encryption-quarantine"}
+	js, _ := dgnats.GetJs()
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	if err := dgnats.Publish(ctx, subject, &TestStruct{Content: "pii"}); !errors.Is(err, dgnats.ErrNoKeyProvider) {
+		t.Fatalf("expected no key provider error, got %v", err)
+	}
+
+	provider, err := dgnats.NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte(strings.Repeat("1", 32))})
+	if err != nil {
+		t.Fatalf("new key provider error: %v", err)
+	}
+	if err = dgnats.EnableEncryption(&dgnats.EncryptionConfig{KeyProvider: provider, QuarantineSubject: quarantine}); err != nil {
+		t.Fatalf("enable encryption error: %v", err)
+	}
+
+	received := make(chan string, 2)
+	_, err = dgnats.SubscribeJson(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		received <- ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	for _, keyId := range []string{"k1", "k2"} {
+		if keyId == "k2" {
+			_ = provider.Rotate("k2", []byte(strings.Repeat("2", 32)))
+		}
+		if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "pii-" + keyId}); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+		raw, err := js.GetLastMsg(subject.GetStream(), subject.GetSubject())
+		if err != nil {
+			t.Fatalf("get last msg error: %v", err)
+		}
+		if raw.Header.Get("enc-key-id") != keyId || strings.Contains(string(raw.Data), "pii") {
+			t.Errorf("expected message encrypted with %s", keyId)
+		}
+
+		select {
+		case content := <-received:
+			if content != "pii-"+keyId {
+				t.Errorf("unexpected content: %s", content)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected message encrypted with %s", keyId)
+		}
+	}
+
+	if err = dgnats.Publish(ctx, lost, &TestStruct{Content: "lost"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	other, _ := dgnats.NewStaticKeyProvider("k3", map[string][]byte{"k3": []byte(strings.Repeat("3", 32))})
+	_ = dgnats.EnableEncryption(&dgnats.EncryptionConfig{KeyProvider: other, QuarantineSubject: quarantine})
+	_, err = dgnats.Subscribe(ctx, lost, func(ctx *dgctx.DgContext, bytes []byte) error {
+		t.Errorf("undecryptable message delivered")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		raw, err := js.GetLastMsg(quarantine.GetStream(), quarantine.GetSubject())
+		if err == nil {
+			if raw.Header.Get("quarantine-subject") != lost.GetSubject() {
+				t.Errorf("unexpected quarantine header: %v", raw.Header)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected quarantined message: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type flakyKeyProvider struct {
+	*dgnats.StaticKeyProvider
+	down atomic.Bool
+}
+
+func (p *flakyKeyProvider) UnwrapKey(keyId string, wrappedKey []byte) ([]byte, error) {
+	if p.down.Load() {
+		return nil, errors.New("kms unavailable")
+	}
+
+	return p.StaticKeyProvider.UnwrapKey(keyId, wrappedKey)
+}
+
+func TestEncryptionProviderOutage(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-encryption-outage", Name: "test-encryption-outage", Group: "group", Encrypt: true}
+	quarantine := &dgnats.NatsSubject{Category: "test-encryption-outage", Name: "test-encryption-outage-quarantine"}
+	js, _ := dgnats.GetJs()
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	retryWait := dgnats.SubWorkErrorRetryWait
+	dgnats.SubWorkErrorRetryWait = 500 * time.Millisecond
+	defer func() { dgnats.SubWorkErrorRetryWait = retryWait }()
+
+	static, _ := dgnats.NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte(strings.Repeat("1", 32))})
+	provider := &flakyKeyProvider{StaticKeyProvider: static}
+	_ = dgnats.EnableEncryption(&dgnats.EncryptionConfig{KeyProvider: provider, QuarantineSubject: quarantine})
+	if err := dgnats.Publish(ctx, subject, &TestStruct{Content: "pii"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	provider.down.Store(true)
+	received := make(chan string, 1)
+	_, err := dgnats.SubscribeJson(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		received <- ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	select {
+	case <-received:
+		t.Fatalf("message delivered while key provider is down")
+	case <-time.After(time.Second):
+	}
+	if _, err = js.GetLastMsg(quarantine.GetStream(), quarantine.GetSubject()); err == nil {
+		t.Fatalf("expected message not quarantined on key provider error")
+	}
+
+	provider.down.Store(false)
+	select {
+	case content := <-received:
+		if content != "pii" {
+			t.Errorf("unexpected content: %s", content)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected message redelivered after key provider recovered")
+	}
+}
+
+func TestClaimCheck(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-claim-check", Name: "test-claim-check", Group: "group", MaxAge: time.Hour}
+	js, _ := dgnats.GetJs()
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	received := make(chan int, 1)
+	_, err := dgnats.Subscribe(ctx, subject, func(ctx *dgctx.DgContext, bytes []byte) error {
+		received <- len(bytes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	data := []byte(strings.Repeat("x", 2<<20))
+	if err = dgnats.PublishRaw(ctx, subject, data); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	raw, err := js.GetLastMsg(subject.GetStream(), subject.GetSubject())
+	if err != nil {
+		t.Fatalf("get last msg error: %v", err)
+	}
+	if raw.Header.Get("claim-check") == "" || len(raw.Data) != 0 {
+		t.Errorf("expected claim check reference, got header %v with %d bytes", raw.Header, len(raw.Data))
+	}
+
+	select {
+	case size := <-received:
+		if size != len(data) {
+			t.Errorf("expected %d bytes, got %d", len(data), size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected claim checked message")
+	}
+
+	store, err := js.ObjectStore("test-claim-check-claim-check")
+	if err != nil {
+		t.Fatalf("get object store error: %v", err)
+	}
+	status, _ := store.Status()
+	if status.TTL() != time.Hour {
+		t.Errorf("expected object store ttl to follow stream max age, got %v", status.TTL())
+	}
+
+	longer := &dgnats.NatsSubject{Category: "test-claim-check", Name: "test-claim-check-longer", MaxAge: 2 * time.Hour}
+	if err = dgnats.PublishRaw(ctx, longer, data); err != nil {
+		t.Fatalf("publish longer error: %v", err)
+	}
+	status, _ = store.Status()
+	if status.TTL() != 2*time.Hour {
+		t.Errorf("expected object store ttl to follow the longest subject max age, got %v", status.TTL())
+	}
+}
+
+func TestPublishWithHeaders(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-headers", Name: "test-headers", Group: "group"}
+	rawSubject := &dgnats.NatsSubject{Category: "test-headers", Name: "test-headers", Group: "group-raw"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	received := make(chan string, 2)
+	_, err := dgnats.SubscribeJsonWithHeaders(ctx, subject, func(ctx *dgctx.DgContext, header nats.Header, ts *TestStruct) error {
+		received <- "json:" + header.Get("tenant-id") + ":" + header.Get(dgnats.HeaderContentType) + ":" + ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	_, err = dgnats.SubscribeWithHeaders(ctx, rawSubject, func(ctx *dgctx.DgContext, header nats.Header, bytes []byte) error {
+		received <- "raw:" + header.Get("tenant-id") + ":" + header.Get(dgnats.HeaderTraceId)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	header := nats.Header{}
+	header.Set("tenant-id", "t1")
+	if err = dgnats.PublishWithHeaders(ctx, subject, header, &TestStruct{Content: "123"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if len(header) != 1 {
+		t.Errorf("expected caller header untouched, got %v", header)
+	}
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-received:
+			got[s] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected message, got %v", got)
+		}
+	}
+	if !got["json:t1:application/json:123"] || !got["raw:t1:"+ctx.TraceId] {
+		t.Errorf("unexpected messages: %v", got)
+	}
+
+	if err = dgnats.PublishRawWithHeaders(ctx, rawSubject, nats.Header{"tenant-id": {"t2"}}, []byte(`{"content":"456"}`)); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	got = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-received:
+			got[s] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected message, got %v", got)
+		}
+	}
+	if !got["raw:t2:"+ctx.TraceId] || !got["json:t2::456"] {
+		t.Errorf("unexpected messages: %v", got)
+	}
+}
+
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.buf.Write(p)
+}
+
+func (c *logCapture) take() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	logs := c.buf.String()
+	c.buf.Reset()
+	return logs
+}
+
+func captureLogs(t *testing.T) *logCapture {
+	c := &logCapture{}
+	logger := dglogger.GlobalDgLogger
+	dglogger.GlobalDgLogger = dglogger.NewDgLogger(dglogger.InfoLevel, dglogger.DefaultTimestampFormat, c)
+	t.Cleanup(func() { dglogger.GlobalDgLogger = logger })
+
+	return c
+}
+
+func TestPayloadLog(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Namespace: "test-log", Category: "test-payload-log", Name: "test-payload-log"}
+	encrypted := &dgnats.NatsSubject{Namespace: "test-log", Category: "test-payload-log", Name: "test-payload-log-encrypted", Encrypt: true}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteStream("test-log-dgnats-delay")
+		dgnats.SetPayloadLogConfig(nil)
+	}()
+	logs := captureLogs(t)
+
+	publish := func(subject *dgnats.NatsSubject) string {
+		if err := dgnats.Publish(ctx, subject, &TestStruct{Content: "secret"}); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+		return logs.take()
+	}
+
+	if line := publish(subject); !strings.Contains(line, `"content":"secret"`) || !strings.Contains(line, "test-log.test-payload-log") {
+		t.Errorf("expected full payload logged by default: %s", line)
+	}
+
+	provider, _ := dgnats.NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte(strings.Repeat("1", 32))})
+	_ = dgnats.EnableEncryption(&dgnats.EncryptionConfig{KeyProvider: provider})
+	if line := publish(encrypted); strings.Contains(line, "secret") || !strings.Contains(line, "bytes, msg id") {
+		t.Errorf("expected only metadata logged for encrypted subject: %s", line)
+	}
+
+	// overrides match the subject without namespace and the most specific pattern wins
+	dgnats.SetPayloadLogConfig(&dgnats.PayloadLogConfig{
+		Mode: dgnats.PayloadLogFull,
+		Overrides: map[string]*dgnats.PayloadLogConfig{
+			"test-payload-log": {Mode: dgnats.PayloadLogMetadata},
+			"*":                {Mode: dgnats.PayloadLogOff},
+			">":                {Mode: dgnats.PayloadLogOff},
+		},
+	})
+	for i := 0; i < 10; i++ {
+		if line := publish(subject); strings.Contains(line, "secret") || !strings.Contains(line, "bytes, msg id") {
+			t.Fatalf("expected metadata override: %s", line)
+		}
+	}
+
+	dgnats.SetPayloadLogConfig(&dgnats.PayloadLogConfig{Mode: dgnats.PayloadLogFull, RedactPaths: []string{"content"}})
+	if line := publish(subject); strings.Contains(line, "secret") || !strings.Contains(line, `"content":"***"`) {
+		t.Errorf("expected redacted payload: %s", line)
+	}
+
+	dgnats.SetPayloadLogConfig(&dgnats.PayloadLogConfig{Mode: dgnats.PayloadLogTruncated, MaxBytes: 8})
+	if line := publish(subject); !strings.Contains(line, `{"conten...`) {
+		t.Errorf("expected truncated payload: %s", line)
+	}
+
+	dgnats.SetPayloadLogConfig(&dgnats.PayloadLogConfig{Mode: dgnats.PayloadLogFull, SampleRate: 1e-9})
+	for i := 0; i < 10; i++ {
+		if line := publish(subject); strings.Contains(line, "secret") {
+			t.Fatalf("expected sampled out payload: %s", line)
+		}
+	}
+
+	dgnats.SetPayloadLogConfig(&dgnats.PayloadLogConfig{Mode: dgnats.PayloadLogMetadata})
+	if _, err := dgnats.PublishDelay(ctx, subject, []byte("delayed"), time.Hour, dgnats.WithMsgId("delay-log")); err != nil {
+		t.Fatalf("publish delay error: %v", err)
+	}
+	if line := logs.take(); !strings.Contains(line, "msg id delay-log") {
+		t.Errorf("expected delay publish logged with msg id: %s", line)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-middleware", Name: "test-middleware", Group: "group"}
+	rejected := &dgnats.NatsSubject{Category: "test-middleware", Name: "test-middleware-rejected"}
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		dgnats.ResetMiddlewares()
+	}()
+
+	var order []string
+	dgnats.UsePublishMiddleware(func(next dgnats.PublishHandler) dgnats.PublishHandler {
+		return func(ctx *dgctx.DgContext, subject *dgnats.NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+			order = append(order, "global")
+			msg.Header.Set("auth", "token")
+			return next(ctx, subject, msg)
+		}
+	})
+	dgnats.UseSubjectPublishMiddleware(subject, func(next dgnats.PublishHandler) dgnats.PublishHandler {
+		return func(ctx *dgctx.DgContext, subject *dgnats.NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+			order = append(order, "subject")
+			return next(ctx, subject, msg)
+		}
+	})
+	rejectErr := errors.New("rejected")
+	dgnats.UseSubjectPublishMiddleware(rejected, func(next dgnats.PublishHandler) dgnats.PublishHandler {
+		return func(ctx *dgctx.DgContext, subject *dgnats.NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+			return nil, rejectErr
+		}
+	})
+
+	consumed := make(chan string, 1)
+	dgnats.UseSubjectConsumeMiddleware(subject, func(next dgnats.ConsumeHandler) dgnats.ConsumeHandler {
+		return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+			consumed <- msg.Header.Get("auth")
+			return next(ctx, msg)
+		}
+	})
+
+	received := make(chan string, 1)
+	_, err := dgnats.SubscribeJson(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		received <- ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "123"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if len(order) != 2 || order[0] != "global" || order[1] != "subject" {
+		t.Errorf("unexpected middleware order: %v", order)
+	}
+	if err = dgnats.Publish(ctx, rejected, &TestStruct{Content: "123"}); !errors.Is(err, rejectErr) {
+		t.Errorf("expected rejected error, got %v", err)
+	}
+
+	select {
+	case auth := <-consumed:
+		if auth != "token" {
+			t.Errorf("unexpected auth header: %s", auth)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected consume middleware")
+	}
+	select {
+	case content := <-received:
+		if content != "123" {
+			t.Errorf("unexpected content: %s", content)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected message")
+	}
+}
+
+func TestMiddlewareBeforeConnect(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+
+	subject := &dgnats.NatsSubject{Category: "test-middleware", Name: "test-middleware"}
+	rejectErr := errors.New("rejected")
+	dgnats.UseSubjectPublishMiddleware(subject, func(next dgnats.PublishHandler) dgnats.PublishHandler {
+		return func(ctx *dgctx.DgContext, subject *dgnats.NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+			return nil, rejectErr
+		}
+	})
+	defer dgnats.ResetMiddlewares()
+
+	connectTestInNamespace(t, "test-mw")
+	if err := dgnats.Publish(ctx, subject, &TestStruct{Content: "123"}); !errors.Is(err, rejectErr) {
+		t.Errorf("expected middleware to apply in namespace, got %v", err)
+	}
+}
+
+func TestWildcardConsumeMiddleware(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-middleware-wild", Name: "test-middleware-wild.*", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		dgnats.ResetMiddlewares()
+	}()
+
+	var hits atomic.Int32
+	dgnats.UseSubjectConsumeMiddleware(subject, func(next dgnats.ConsumeHandler) dgnats.ConsumeHandler {
+		return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+			hits.Add(1)
+			return next(ctx, msg)
+		}
+	})
+
+	received := make(chan struct{}, 1)
+	_, err := dgnats.Subscribe(ctx, subject, func(ctx *dgctx.DgContext, bytes []byte) error {
+		received <- struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if _, err = js.Publish("test-middleware-wild.created", []byte("123")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	select {
+	case <-received:
+		if hits.Load() != 1 {
+			t.Errorf("expected wildcard middleware to run once, got %d", hits.Load())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("message not received")
+	}
+}
+
+func TestPublishExpectLastSequence(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-expect", Name: "test-expect"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	ack, err := dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "1"}, dgnats.WithExpectLastSequencePerSubject(0), dgnats.WithMsgId("event-1"))
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	attempts := 0
+	policy := &dgnats.RetryPolicy{MaxAttempts: 3, Retryable: func(error) bool {
+		attempts++
+		return true
+	}}
+	_, err = dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "2"}, dgnats.WithExpectLastSequencePerSubject(ack.Sequence+1), dgnats.WithRetryPolicy(policy))
+	if !errors.Is(err, dgnats.ErrWrongLastSequence) {
+		t.Fatalf("expected wrong last sequence error, got %v", err)
+	}
+	if attempts != 0 {
+		t.Errorf("wrong last sequence must not be retried")
+	}
+
+	_, err = dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "2"}, dgnats.WithExpectLastMsgId("event-0"))
+	if !errors.Is(err, dgnats.ErrWrongLastSequence) {
+		t.Errorf("expected wrong last msg id error, got %v", err)
+	}
+
+	ack, err = dgnats.PublishWithAck(ctx, subject, &TestStruct{Content: "2"}, dgnats.WithExpectLastSequence(ack.Sequence), dgnats.WithExpectLastMsgId("event-1"))
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	future, err := dgnats.PublishAsync(ctx, subject, &TestStruct{Content: "3"}, dgnats.WithExpectLastSequence(ack.Sequence-1))
+	if err != nil {
+		t.Fatalf("publish async error: %v", err)
+	}
+	if _, err = future.Ack(); !errors.Is(err, dgnats.ErrWrongLastSequence) {
+		t.Errorf("expected async wrong last sequence error, got %v", err)
+	}
+}
+
+func TestPublishWithTTL(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-ttl", Name: "test-ttl", Group: "group", StaleAfter: time.Second}
+	js, _ := dgnats.GetJs()
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: subject.GetStream(), Subjects: []string{subject.GetSubject()}})
+	if err != nil {
+		t.Fatalf("add stream error: %v", err)
+	}
+
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "expiring"}, dgnats.WithTTL(time.Second)); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	info, _ := js.StreamInfo(subject.GetStream())
+	if !info.Config.AllowMsgTTL {
+		t.Errorf("expected stream to allow msg ttl")
+	}
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "stale"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	info, _ = js.StreamInfo(subject.GetStream())
+	if info.State.Msgs != 1 {
+		t.Errorf("expected expiring message removed, got %d messages", info.State.Msgs)
+	}
+
+	received := make(chan string, 2)
+	_, err = dgnats.SubscribeJson(ctx, subject, func(ctx *dgctx.DgContext, ts *TestStruct) error {
+		received <- ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "fresh"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	select {
+	case content := <-received:
+		if content != "fresh" {
+			t.Errorf("expected stale message dropped, got %s", content)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected fresh message")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-rate-limit", Name: "test-rate-limit"}
+	other := &dgnats.NatsSubject{Category: "test-rate-limit", Name: "test-rate-limit-other"}
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		dgnats.SetSubjectRateLimit(subject, nil)
+		dgnats.SetCategoryRateLimit("", "test-rate-limit", nil)
+	}()
+
+	dgnats.SetSubjectRateLimit(subject, &dgnats.RateLimitConfig{Rate: 1, Burst: 1, Mode: dgnats.RateLimitFail})
+	if err := dgnats.PublishRaw(ctx, subject, []byte("1")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if err := dgnats.PublishRaw(ctx, subject, []byte("2")); !errors.Is(err, dgnats.ErrRateLimited) {
+		t.Errorf("expected rate limited error, got %v", err)
+	}
+
+	dgnats.SetCategoryRateLimit("", "test-rate-limit", &dgnats.RateLimitConfig{Rate: 10, Burst: 1})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := dgnats.PublishRaw(ctx, other, []byte("other")); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected blocked publishes, took %v", elapsed)
+	}
+
+	stats := dgnats.GetRateLimitStats()
+	if s := stats["subject:"+subject.GetSubject()]; s.Allowed != 1 || s.Rejected != 1 {
+		t.Errorf("unexpected subject stats: %+v", s)
+	}
+	if s := stats["category:"+subject.GetStream()]; s.Allowed != 1 || s.Throttled != 2 || s.WaitTime <= 0 {
+		t.Errorf("unexpected category stats: %+v", s)
+	}
+
+	// a category rejection must not use up the subject budget
+	third := &dgnats.NatsSubject{Category: "test-rate-limit", Name: "test-rate-limit-third"}
+	defer dgnats.SetSubjectRateLimit(other, nil)
+	dgnats.SetSubjectRateLimit(other, &dgnats.RateLimitConfig{Rate: 0.001, Burst: 1, Mode: dgnats.RateLimitFail})
+	dgnats.SetCategoryRateLimit("", "test-rate-limit", &dgnats.RateLimitConfig{Rate: 0.001, Burst: 1, Mode: dgnats.RateLimitFail})
+	if err := dgnats.PublishRaw(ctx, third, []byte("third")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if err := dgnats.PublishRaw(ctx, other, []byte("other")); !errors.Is(err, dgnats.ErrRateLimited) {
+		t.Fatalf("expected category rate limited error, got %v", err)
+	}
+	dgnats.SetCategoryRateLimit("", "test-rate-limit", nil)
+	if err := dgnats.PublishRaw(ctx, other, []byte("other")); err != nil {
+		t.Errorf("expected subject budget kept after category rejection, got %v", err)
+	}
+}
+
+func TestRateLimitBeforeConnect(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+
+	subject := &dgnats.NatsSubject{Category: "test-rate-limit", Name: "test-rate-limit"}
+	dgnats.SetSubjectRateLimit(subject, &dgnats.RateLimitConfig{Rate: 1, Burst: 1, Mode: dgnats.RateLimitFail})
+	defer dgnats.SetSubjectRateLimit(subject, nil)
+
+	connectTestInNamespace(t, "test-rl")
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	if err := dgnats.PublishRaw(ctx, subject, []byte("1")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if err := dgnats.PublishRaw(ctx, subject, []byte("2")); !errors.Is(err, dgnats.ErrRateLimited) {
+		t.Errorf("expected rate limited error in namespace, got %v", err)
+	}
+	if _, ok := dgnats.GetRateLimitStats()["subject:test-rl.test-rate-limit"]; !ok {
+		t.Errorf("expected stats keyed by namespaced subject: %v", dgnats.GetRateLimitStats())
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-schema", Name: "test-schema", Group: "group"}
+	js, _ := dgnats.GetJs()
+	defer func() {
+		_ = dgnats.DeleteStream(ctx, subject)
+		_ = js.DeleteKeyValue("dgnats-schemas")
+		dgnats.DisableSchemaRegistry()
+	}()
+
+	_ = js.DeleteKeyValue("dgnats-schemas")
+	dgnats.EnableSchemaRegistry()
+	if err := dgnats.Publish(ctx, subject, &TestStruct{}); err != nil {
+		t.Fatalf("publish without registry bucket error: %v", err)
+	}
+	if _, err := js.KeyValue("dgnats-schemas"); !errors.Is(err, nats.ErrBucketNotFound) {
+		t.Errorf("expected schema bucket not to be created, got %v", err)
+	}
+
+	v1 := `{"type":"object","properties":{"content":{"type":"string"}},"required":["content"]}`
+	version, err := dgnats.RegisterSchema(ctx, subject, v1)
+	if err != nil || version != 1 {
+		t.Fatalf("register schema error: %d, %v", version, err)
+	}
+	if version, _ = dgnats.RegisterSchema(ctx, subject, v1); version != 1 {
+		t.Errorf("expected identical schema to keep version 1, got %d", version)
+	}
+	_, err = dgnats.RegisterSchema(ctx, subject, `{"type":"object","properties":{"content":{"type":"integer"}}}`)
+	if !errors.Is(err, dgnats.ErrSchemaIncompatible) {
+		t.Errorf("expected incompatible error, got %v", err)
+	}
+	_, err = dgnats.RegisterSchema(ctx, subject, `{"type":"object","properties":{"content":{"type":"string"},"id":{"type":"string"}},"required":["content","id"]}`)
+	if !errors.Is(err, dgnats.ErrSchemaIncompatible) {
+		t.Errorf("expected incompatible error for new required field, got %v", err)
+	}
+	v2 := `{"type":"object","properties":{"content":{"type":"string","minLength":1},"id":{"type":"string"}},"required":["content"]}`
+	if version, err = dgnats.RegisterSchema(ctx, subject, v2); err != nil || version != 2 {
+		t.Fatalf("register schema error: %d, %v", version, err)
+	}
+	info, err := dgnats.GetSchema(ctx, subject, 0)
+	if err != nil || info.Version != 2 {
+		t.Fatalf("get schema error: %v, %v", info, err)
+	}
+
+	received := make(chan string, 2)
+	_, err = dgnats.SubscribeJsonWithHeaders(ctx, subject, func(ctx *dgctx.DgContext, header nats.Header, ts *TestStruct) error {
+		received <- header.Get(dgnats.HeaderSchemaVersion) + ":" + ts.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	if err = dgnats.Publish(ctx, subject, &TestStruct{}); !errors.Is(err, dgnats.ErrSchemaValidation) {
+		t.Errorf("expected schema validation error, got %v", err)
+	}
+	if err = dgnats.PublishRaw(ctx, subject, []byte(`{"content":1}`)); err != nil {
+		t.Fatalf("publish raw error: %v", err)
+	}
+	if err = dgnats.Publish(ctx, subject, &TestStruct{Content: "valid"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	select {
+	case s := <-received:
+		if s != "2:valid" {
+			t.Errorf("unexpected message: %s", s)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected valid message")
+	}
+	select {
+	case s := <-received:
+		t.Errorf("invalid message delivered: %s", s)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	broken := &dgnats.NatsSubject{Category: "test-schema", Name: "test-schema-broken"}
+	kv, _ := js.KeyValue("dgnats-schemas")
+	prefix := base64.RawURLEncoding.EncodeToString([]byte(broken.GetSubject())) + "."
+	_, _ = kv.Put(prefix+"latest", []byte("1"))
+	_, _ = kv.Put(prefix+"1", []byte("broken"))
+	if err = dgnats.Publish(ctx, broken, &TestStruct{Content: "valid"}); err != nil {
+		t.Errorf("expected schema lookup error to fail open by default, got %v", err)
+	}
+	dgnats.SchemaFailClosed = true
+	defer func() { dgnats.SchemaFailClosed = false }()
+	for i := 0; i < 2; i++ {
+		if err = dgnats.Publish(ctx, broken, &TestStruct{Content: "valid"}); err == nil {
+			t.Errorf("expected schema lookup error on attempt %d", i+1)
+		}
+	}
+}
+
+type VersionedStruct struct {
+	Content string `json:"content"`
+	Title   string `json:"title"`
+}
+
+func TestUpcaster(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-version", Name: "test-version", Group: "group"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	dgnats.RegisterMsgVersion[VersionedStruct](3)
+	dgnats.RegisterUpcaster[VersionedStruct](1, func(data []byte) ([]byte, error) {
+		var v1 map[string]any
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]any{"content": v1["text"]})
+	})
+	dgnats.RegisterUpcaster[VersionedStruct](2, func(data []byte) ([]byte, error) {
+		var v2 map[string]any
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		v2["title"] = "untitled"
+		return json.Marshal(v2)
+	})
+
+	received := make(chan string, 3)
+	_, err := dgnats.SubscribeJsonWithHeaders(ctx, subject, func(ctx *dgctx.DgContext, header nats.Header, vs *VersionedStruct) error {
+		received <- header.Get(dgnats.HeaderMsgVersion) + ":" + vs.Content + ":" + vs.Title
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	if err = dgnats.PublishRaw(ctx, subject, []byte(`{"text":"v1"}`)); err != nil {
+		t.Fatalf("publish raw error: %v", err)
+	}
+	if err = dgnats.PublishRawWithHeaders(ctx, subject, nats.Header{dgnats.HeaderMsgVersion: []string{"2"}}, []byte(`{"content":"v2"}`)); err != nil {
+		t.Fatalf("publish raw error: %v", err)
+	}
+	if err = dgnats.Publish(ctx, subject, &VersionedStruct{Content: "v3", Title: "current"}); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+
+	expected := map[string]bool{":v1:untitled": true, "2:v2:untitled": true, "3:v3:current": true}
+	for range 3 {
+		select {
+		case s := <-received:
+			if !expected[s] {
+				t.Errorf("unexpected message: %s", s)
+			}
+			delete(expected, s)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("missing messages: %v", expected)
+		}
+	}
+}
+
+func TestCloudEvent(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-ce", Name: "test-ce", Group: "group"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	received := make(chan *dgnats.CloudEvent[TestStruct], 2)
+	_, err := dgnats.SubscribeCloudEvent(ctx, subject, func(ctx *dgctx.DgContext, event *dgnats.CloudEvent[TestStruct]) error {
+		if event.TraceId != ctx.TraceId {
+			t.Errorf("unexpected trace id: %s, %s", event.TraceId, ctx.TraceId)
+		}
+		received <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	if err = dgnats.PublishCloudEvent(ctx, subject, &dgnats.CloudEvent[TestStruct]{Type: "test.created"}); !errors.Is(err, dgnats.ErrInvalidCloudEvent) {
+		t.Errorf("expected invalid cloud event error, got %v", err)
+	}
+	binary := &dgnats.CloudEvent[TestStruct]{Source: "/test", Type: "test.created", Data: &TestStruct{Content: "binary"}}
+	if err = dgnats.PublishCloudEvent(ctx, subject, binary); err != nil {
+		t.Fatalf("publish binary cloud event error: %v", err)
+	}
+	structured := &dgnats.CloudEvent[TestStruct]{Source: "/test", Type: "test.updated", Data: &TestStruct{Content: "structured"}}
+	if err = dgnats.PublishCloudEventStructured(ctx, subject, structured); err != nil {
+		t.Fatalf("publish structured cloud event error: %v", err)
+	}
+
+	for _, expected := range []*dgnats.CloudEvent[TestStruct]{binary, structured} {
+		select {
+		case event := <-received:
+			if event.Id != expected.Id || event.Source != "/test" || event.Type != expected.Type ||
+				event.SpecVersion != dgnats.CloudEventsSpecVersion || !event.Time.Equal(expected.Time) ||
+				event.DataContentType != dgnats.ContentTypeJson || event.TraceId != ctx.TraceId ||
+				event.Data == nil || event.Data.Content != expected.Data.Content {
+				t.Errorf("unexpected cloud event: %+v", event)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected cloud event %s", expected.Type)
+		}
+	}
+}
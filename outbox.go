@@ -0,0 +1,348 @@
+package dgnats
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darwinOrg/go-common/constants"
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	OutboxDialectMySQL    = "mysql"
+	OutboxDialectPostgres = "postgres"
+	OutboxDialectSQLite   = "sqlite"
+
+	defaultOutboxTable        = "nats_outbox"
+	defaultOutboxBatchSize    = 100
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxLockTimeout  = 30 * time.Second
+)
+
+var unknownOutboxDialectError = errors.New("unknown outbox dialect")
+
+type OutboxConfig struct {
+	Dialect      string        `json:"dialect" binding:"required" remark:"数据库方言: mysql/postgres/sqlite"`
+	Table        string        `json:"table" remark:"表名, 默认nats_outbox"`
+	BatchSize    int           `json:"batchSize" remark:"每次投递的最大行数"`
+	PollInterval time.Duration `json:"pollInterval" remark:"轮询间隔"`
+	LockTimeout  time.Duration `json:"lockTimeout" remark:"行锁定超时, 超时后其他实例可重新认领"`
+	MaxAttempts  int           `json:"maxAttempts" remark:"最大投递次数, 0为不限制"`
+	MsgIdPrefix  string        `json:"msgIdPrefix" remark:"消息id前缀, 设置时消息id为前缀+行id, 需保证跨服务和分库唯一; 为空时写入时生成全局唯一消息id"`
+}
+
+type OutboxExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type OutboxRelay struct {
+	db         *sql.DB
+	conf       *OutboxConfig
+	instanceId string
+	stopCh     chan struct{}
+	stopOnce   sync.Once
+	doneCh     chan struct{}
+}
+
+type outboxRow struct {
+	id      int64
+	subject string
+	headers string
+	payload []byte
+}
+
+func OutboxSchema(conf *OutboxConfig) ([]string, error) {
+	table := conf.table()
+	index := fmt.Sprintf("idx_%s_sent_at", table)
+
+	switch conf.Dialect {
+	case OutboxDialectMySQL:
+		return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	subject TEXT NOT NULL,
+	headers TEXT NOT NULL,
+	payload LONGBLOB NOT NULL,
+	created_at BIGINT NOT NULL,
+	locked_by VARCHAR(64) NOT NULL DEFAULT '',
+	locked_until BIGINT NOT NULL DEFAULT 0,
+	sent_at BIGINT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT NULL,
+	KEY %s (sent_at, id)
+)`, table, index)}, nil
+	case OutboxDialectPostgres, OutboxDialectSQLite:
+		return []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id %s,
+	subject TEXT NOT NULL,
+	headers TEXT NOT NULL,
+	payload %s NOT NULL,
+	created_at BIGINT NOT NULL,
+	locked_by VARCHAR(64) NOT NULL DEFAULT '',
+	locked_until BIGINT NOT NULL DEFAULT 0,
+	sent_at BIGINT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT NULL
+)`, table,
+			utils.IfReturn(conf.Dialect == OutboxDialectPostgres, "BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT"),
+			utils.IfReturn(conf.Dialect == OutboxDialectPostgres, "BYTEA", "BLOB")),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (sent_at, id)", index, table),
+		}, nil
+	default:
+		return nil, unknownOutboxDialectError
+	}
+}
+
+func CreateOutboxTable(ctx *dgctx.DgContext, db OutboxExecer, conf *OutboxConfig) error {
+	statements, err := OutboxSchema(conf)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		if _, err := db.ExecContext(innerContext(ctx), statement); err != nil {
+			dglogger.Errorf(ctx, "create outbox table[%s] error: %v", conf.table(), err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func InsertOutbox(ctx *dgctx.DgContext, tx OutboxExecer, conf *OutboxConfig, subject *NatsSubject, obj any) error {
+	if err := subject.validatePublish(); err != nil {
+		return err
+	}
+
+	bytes, header, err := encodePayload(ctx, subject, obj)
+	if err != nil {
+		return err
+	}
+	header[constants.TraceId] = []string{ctx.TraceId}
+	if conf.MsgIdPrefix == "" {
+		header[HeaderMsgId] = []string{"outbox-" + nuid.Next()}
+	}
+
+	subjectJson, err := utils.ConvertBeanToJsonString(subject)
+	if err != nil {
+		return err
+	}
+	headersJson, err := utils.ConvertBeanToJsonString(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(innerContext(ctx), conf.rebind(fmt.Sprintf(
+		"INSERT INTO %s (subject, headers, payload, created_at) VALUES (?, ?, ?, ?)", conf.table())),
+		subjectJson, headersJson, bytes, time.Now().UnixMilli())
+	if err != nil {
+		dglogger.Errorf(ctx, "insert outbox[%s] error: %v", conf.table(), err)
+	}
+
+	return err
+}
+
+func NewOutboxRelay(db *sql.DB, conf *OutboxConfig) *OutboxRelay {
+	return &OutboxRelay{
+		db:         db,
+		conf:       conf,
+		instanceId: nuid.Next(),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+func (r *OutboxRelay) Start(ctx *dgctx.DgContext) {
+	if ctx == nil {
+		ctx = dgctx.SimpleDgContext()
+	}
+	pollInterval := utils.IfReturn(r.conf.PollInterval > 0, r.conf.PollInterval, defaultOutboxPollInterval)
+	r.doneCh = make(chan struct{})
+
+	go func() {
+		defer close(r.doneCh)
+
+		for {
+			relayed, err := r.RelayOnce(ctx)
+			if err != nil {
+				dglogger.Errorf(ctx, "relay outbox[%s] error: %v", r.conf.table(), err)
+			}
+			if relayed > 0 && err == nil {
+				continue
+			}
+
+			select {
+			case <-time.After(pollInterval):
+			case <-r.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (r *OutboxRelay) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+	if r.doneCh != nil {
+		<-r.doneCh
+	}
+}
+
+func (r *OutboxRelay) RelayOnce(ctx *dgctx.DgContext) (int, error) {
+	ids, err := r.claim(ctx)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		err = r.relay(ctx, id)
+		if err != nil {
+			r.release(ctx, ids[i+1:])
+			return i, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+func (r *OutboxRelay) claim(ctx *dgctx.DgContext) ([]int64, error) {
+	now := time.Now().UnixMilli()
+	query := fmt.Sprintf("SELECT id FROM %s WHERE sent_at = 0 AND locked_until < ?", r.conf.table())
+	args := []any{now}
+	if r.conf.MaxAttempts > 0 {
+		query += " AND attempts < ?"
+		args = append(args, r.conf.MaxAttempts)
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, utils.IfReturn(r.conf.BatchSize > 0, r.conf.BatchSize, defaultOutboxBatchSize))
+
+	rows, err := r.db.QueryContext(innerContext(ctx), r.conf.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	lockedUntil := time.Now().Add(utils.IfReturn(r.conf.LockTimeout > 0, r.conf.LockTimeout, defaultOutboxLockTimeout)).UnixMilli()
+	update := r.conf.rebind(fmt.Sprintf(
+		"UPDATE %s SET locked_by = ?, locked_until = ? WHERE id = ? AND sent_at = 0 AND locked_until < ?", r.conf.table()))
+
+	var ids []int64
+	for _, id := range candidates {
+		result, err := r.db.ExecContext(innerContext(ctx), update, r.instanceId, lockedUntil, id, now)
+		if err != nil {
+			return ids, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (r *OutboxRelay) relay(ctx *dgctx.DgContext, id int64) error {
+	var row outboxRow
+	err := r.db.QueryRowContext(innerContext(ctx), r.conf.rebind(fmt.Sprintf(
+		"SELECT id, subject, headers, payload FROM %s WHERE id = ? AND locked_by = ?", r.conf.table())),
+		id, r.instanceId).Scan(&row.id, &row.subject, &row.headers, &row.payload)
+	if err != nil {
+		return err
+	}
+
+	err = r.publish(row)
+	if err != nil {
+		_, ue := r.db.ExecContext(innerContext(ctx), r.conf.rebind(fmt.Sprintf(
+			"UPDATE %s SET attempts = attempts + 1, last_error = ?, locked_until = 0 WHERE id = ? AND locked_by = ?", r.conf.table())),
+			err.Error(), id, r.instanceId)
+		if ue != nil {
+			dglogger.Errorf(ctx, "update outbox[%s] row[%d] error: %v", r.conf.table(), id, ue)
+		}
+		return err
+	}
+
+	_, err = r.db.ExecContext(innerContext(ctx), r.conf.rebind(fmt.Sprintf(
+		"UPDATE %s SET sent_at = ?, attempts = attempts + 1, locked_until = 0 WHERE id = ? AND locked_by = ?", r.conf.table())),
+		time.Now().UnixMilli(), id, r.instanceId)
+
+	return err
+}
+
+func (r *OutboxRelay) publish(row outboxRow) error {
+	subject, err := utils.ConvertJsonStringToBean[NatsSubject](row.subject)
+	if err != nil {
+		return err
+	}
+	header, err := utils.ConvertJsonStringToBean[map[string][]string](row.headers)
+	if err != nil {
+		return err
+	}
+
+	ctx := &dgctx.DgContext{TraceId: nuid.Next()}
+	if traceIds := (*header)[constants.TraceId]; len(traceIds) > 0 && traceIds[0] != "" {
+		ctx.TraceId = traceIds[0]
+	}
+
+	var opts []PublishOption
+	if r.conf.MsgIdPrefix != "" || len((*header)[HeaderMsgId]) == 0 {
+		opts = append(opts, WithMsgId(r.conf.msgIdPrefix()+strconv.FormatInt(row.id, 10)))
+	}
+	_, err = publishRawWithHeader(ctx, subject, *header, row.payload, opts)
+
+	return ignoreSpooled(err)
+}
+
+func (r *OutboxRelay) release(ctx *dgctx.DgContext, ids []int64) {
+	update := r.conf.rebind(fmt.Sprintf("UPDATE %s SET locked_until = 0 WHERE id = ? AND locked_by = ?", r.conf.table()))
+	for _, id := range ids {
+		if _, err := r.db.ExecContext(innerContext(ctx), update, id, r.instanceId); err != nil {
+			dglogger.Errorf(ctx, "release outbox[%s] row[%d] error: %v", r.conf.table(), id, err)
+		}
+	}
+}
+
+func (c *OutboxConfig) table() string {
+	return utils.IfReturn(c.Table != "", c.Table, defaultOutboxTable)
+}
+
+func (c *OutboxConfig) msgIdPrefix() string {
+	return utils.IfReturn(c.MsgIdPrefix != "", c.MsgIdPrefix, "outbox-"+c.table()+"-")
+}
+
+func (c *OutboxConfig) rebind(query string) string {
+	if c.Dialect != OutboxDialectPostgres {
+		return query
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
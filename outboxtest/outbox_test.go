@@ -0,0 +1,110 @@
+package outboxtest_test
+
+import (
+	"database/sql"
+	"testing"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dgnats "github.com/darwinOrg/go-nats"
+	"github.com/nats-io/nats.go"
+	_ "modernc.org/sqlite"
+)
+
+type TestStruct struct {
+	Content string `json:"content"`
+}
+
+func connectTest(t *testing.T) {
+	err := dgnats.Connect(&dgnats.NatsConfig{
+		PoolSize:       1,
+		Servers:        []string{nats.DefaultURL},
+		ConnectionName: "startrek_mq",
+		Username:       "startrek_mq",
+		Password:       "cswjggljrmpypwfccarzpjxG-urepqldkhecvnzxzmngotaqs-bkwdvjgipruectqcowoqb6nj",
+	})
+	if err != nil {
+		t.Fatalf("connect nats error: %v", err)
+	}
+	t.Cleanup(dgnats.Close)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	db, err := sql.Open("sqlite", "file:"+t.TempDir()+"/outbox.db")
+	if err != nil {
+		t.Fatalf("open sqlite error: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	conf := &dgnats.OutboxConfig{Dialect: dgnats.OutboxDialectSQLite}
+	if err := dgnats.CreateOutboxTable(ctx, db, conf); err != nil {
+		t.Fatalf("create outbox table error: %v", err)
+	}
+
+	subject := &dgnats.NatsSubject{Category: "test-outbox", Name: "test-outbox"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	tx, _ := db.Begin()
+	_ = dgnats.InsertOutbox(ctx, tx, conf, subject, &TestStruct{Content: "committed"})
+	_ = dgnats.InsertOutbox(ctx, tx, conf, subject, &TestStruct{Content: "committed too"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+
+	tx, _ = db.Begin()
+	_ = dgnats.InsertOutbox(ctx, tx, conf, subject, &TestStruct{Content: "rolled back"})
+	_ = tx.Rollback()
+
+	first := dgnats.NewOutboxRelay(db, conf)
+	second := dgnats.NewOutboxRelay(db, conf)
+
+	relayed, err := first.RelayOnce(ctx)
+	if err != nil || relayed != 2 {
+		t.Fatalf("unexpected relay result: %d %v", relayed, err)
+	}
+	relayed, err = second.RelayOnce(ctx)
+	if err != nil || relayed != 0 {
+		t.Fatalf("unexpected second relay result: %d %v", relayed, err)
+	}
+
+	js, _ := dgnats.GetJs()
+	si, err := js.StreamInfo(subject.GetStream())
+	if err != nil || si.State.Msgs != 2 {
+		t.Errorf("unexpected stream state: %+v %v", si, err)
+	}
+}
+
+func TestOutboxRelaySharedTableName(t *testing.T) {
+	ctx := dgctx.SimpleDgContext()
+	connectTest(t)
+
+	subject := &dgnats.NatsSubject{Category: "test-outbox-shared", Name: "test-outbox-shared"}
+	defer func() { _ = dgnats.DeleteStream(ctx, subject) }()
+
+	conf := &dgnats.OutboxConfig{Dialect: dgnats.OutboxDialectSQLite}
+	for _, name := range []string{"first", "second"} {
+		db, err := sql.Open("sqlite", "file:"+t.TempDir()+"/"+name+".db")
+		if err != nil {
+			t.Fatalf("open sqlite error: %v", err)
+		}
+		defer func() { _ = db.Close() }()
+
+		if err = dgnats.CreateOutboxTable(ctx, db, conf); err != nil {
+			t.Fatalf("create outbox table error: %v", err)
+		}
+		if err = dgnats.InsertOutbox(ctx, db, conf, subject, &TestStruct{Content: name}); err != nil {
+			t.Fatalf("insert outbox error: %v", err)
+		}
+		if relayed, err := dgnats.NewOutboxRelay(db, conf).RelayOnce(ctx); err != nil || relayed != 1 {
+			t.Fatalf("unexpected relay result: %d %v", relayed, err)
+		}
+	}
+
+	js, _ := dgnats.GetJs()
+	si, err := js.StreamInfo(subject.GetStream())
+	if err != nil || si.State.Msgs != 2 {
+		t.Errorf("expected rows with the same id from different databases both published: %+v %v", si, err)
+	}
+}
@@ -0,0 +1,185 @@
+package dgnats
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	PayloadLogOff       = "off"
+	PayloadLogMetadata  = "metadata"
+	PayloadLogTruncated = "truncated"
+	PayloadLogFull      = "full"
+
+	defaultPayloadLogMaxBytes = 512
+	redactedValue             = "***"
+)
+
+var payloadLogConfig atomic.Pointer[PayloadLogConfig]
+
+type PayloadLogConfig struct {
+	Mode        string                       `json:"mode" remark:"日志策略: off/metadata/truncated/full, 默认full, 加密的subject默认metadata"`
+	MaxBytes    int                          `json:"maxBytes" remark:"truncated策略下最多打印的字节数, 默认512"`
+	RedactPaths []string                     `json:"redactPaths" remark:"json内容中需要脱敏的字段路径, 如user.phone, items.*.cardNo"`
+	SampleRate  float64                      `json:"sampleRate" remark:"采样率(0,1], 0表示全部打印"`
+	Overrides   map[string]*PayloadLogConfig `json:"overrides" remark:"按subject覆盖的配置, key为不含命名空间的subject, 支持*和>通配符"`
+}
+
+func SetPayloadLogConfig(conf *PayloadLogConfig) {
+	payloadLogConfig.Store(conf)
+}
+
+func logPayload(ctx *dgctx.DgContext, action string, subject *NatsSubject, msg *nats.Msg) {
+	if line := formatPayloadLog(resolvePayloadLogConfig(subject), action, subject.GetSubject(), msg); line != "" {
+		dglogger.Info(ctx, line)
+	}
+}
+
+func formatPayloadLog(conf *PayloadLogConfig, action string, subject string, msg *nats.Msg) string {
+	if conf.Mode == PayloadLogOff {
+		return ""
+	}
+	if conf.SampleRate > 0 && conf.SampleRate < 1 && rand.Float64() >= conf.SampleRate {
+		return ""
+	}
+
+	metadata := strconv.Itoa(len(msg.Data)) + " bytes"
+	if msgId := msg.Header.Get(nats.MsgIdHdr); msgId != "" {
+		metadata += ", msg id " + msgId
+	}
+	if contentType := msg.Header.Get(HeaderContentType); contentType != "" {
+		metadata += ", " + contentType
+	}
+
+	switch conf.Mode {
+	case PayloadLogMetadata:
+		return fmt.Sprintf("%s subject[%s] message: %s", action, subject, metadata)
+	case PayloadLogTruncated:
+		data := redactPayload(msg.Data, conf.RedactPaths)
+		maxBytes := conf.MaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultPayloadLogMaxBytes
+		}
+		if len(data) > maxBytes {
+			data = append(data[:maxBytes:maxBytes], "..."...)
+		}
+		return fmt.Sprintf("%s subject[%s] message(%s): %s", action, subject, metadata, data)
+	default:
+		return fmt.Sprintf("%s subject[%s] message: %s", action, subject, redactPayload(msg.Data, conf.RedactPaths))
+	}
+}
+
+func resolvePayloadLogConfig(subject *NatsSubject) *PayloadLogConfig {
+	conf := payloadLogConfig.Load()
+	if conf == nil {
+		conf = &PayloadLogConfig{}
+	}
+
+	// the most specific matching pattern wins so overlapping overrides resolve deterministically
+	best := ""
+	var matched *PayloadLogConfig
+	for pattern, override := range conf.Overrides {
+		if override == nil || !subjectMatches(pattern, subject.Name) {
+			continue
+		}
+		if matched == nil || morePayloadLogSpecific(pattern, best) {
+			best, matched = pattern, override
+		}
+	}
+
+	if matched != nil {
+		conf = matched
+	}
+	if conf.Mode == "" {
+		// encrypted payloads must not be logged in plaintext unless explicitly configured
+		resolved := *conf
+		resolved.Mode = utils.IfReturn(subject.Encrypt, PayloadLogMetadata, PayloadLogFull)
+		return &resolved
+	}
+
+	return conf
+}
+
+func morePayloadLogSpecific(pattern string, than string) bool {
+	if a, b := patternSpecificity(pattern), patternSpecificity(than); a != b {
+		return a > b
+	}
+
+	return pattern < than
+}
+
+func patternSpecificity(pattern string) int {
+	specificity := 0
+	for _, token := range strings.Split(pattern, dot) {
+		switch token {
+		case ">":
+		case "*":
+			specificity++
+		default:
+			specificity += 3
+		}
+	}
+
+	return specificity
+}
+
+func redactPayload(data []byte, paths []string) []byte {
+	if len(paths) == 0 {
+		return data
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return data
+	}
+	for _, path := range paths {
+		redactPath(value, strings.Split(path, dot))
+	}
+	redacted, err := json.Marshal(value)
+	if err != nil {
+		return data
+	}
+
+	return redacted
+}
+
+func redactPath(value any, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	last := len(path) == 1
+
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if last {
+				v[key] = redactedValue
+			} else {
+				redactPath(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			if last {
+				v[i] = redactedValue
+			} else {
+				redactPath(child, path[1:])
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package dgnats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	msgId            string
+	msgIdFromPayload bool
+	failOnDuplicate  bool
+	asyncErrHandler  func(*dgctx.DgContext, *nats.Msg, error)
+	retryPolicy      *RetryPolicy
+
+	expectLastSeq           *uint64
+	expectLastSeqPerSubject *uint64
+	expectLastMsgId         string
+
+	ttl time.Duration
+
+	payloadLogAction string
+}
+
+func WithMsgId(msgId string) PublishOption {
+	return func(o *publishOptions) {
+		o.msgId = msgId
+	}
+}
+
+func WithPayloadMsgId() PublishOption {
+	return func(o *publishOptions) {
+		o.msgIdFromPayload = true
+	}
+}
+
+func WithFailOnDuplicate() PublishOption {
+	return func(o *publishOptions) {
+		o.failOnDuplicate = true
+	}
+}
+
+func WithAsyncErrHandler(handler func(*dgctx.DgContext, *nats.Msg, error)) PublishOption {
+	return func(o *publishOptions) {
+		o.asyncErrHandler = handler
+	}
+}
+
+func WithRetryPolicy(policy *RetryPolicy) PublishOption {
+	return func(o *publishOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+func WithExpectLastSequence(seq uint64) PublishOption {
+	return func(o *publishOptions) {
+		o.expectLastSeq = &seq
+	}
+}
+
+func WithExpectLastSequencePerSubject(seq uint64) PublishOption {
+	return func(o *publishOptions) {
+		o.expectLastSeqPerSubject = &seq
+	}
+}
+
+func WithExpectLastMsgId(msgId string) PublishOption {
+	return func(o *publishOptions) {
+		o.expectLastMsgId = msgId
+	}
+}
+
+func WithTTL(ttl time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		o.ttl = ttl
+	}
+}
+
+func withPayloadLog(action string, opts []PublishOption) []PublishOption {
+	return append([]PublishOption{func(o *publishOptions) {
+		o.payloadLogAction = action
+	}}, opts...)
+}
+
+func buildPublishOptions(opts []PublishOption) *publishOptions {
+	o := &publishOptions{retryPolicy: DefaultPublishRetryPolicy}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+
+	return o
+}
+
+func resolveMsgId(msg *nats.Msg, o *publishOptions) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+
+	switch {
+	case o.msgId != "":
+		msg.Header.Set(nats.MsgIdHdr, o.msgId)
+	case msg.Header.Get(nats.MsgIdHdr) != "":
+	case o.msgIdFromPayload:
+		sum := sha256.Sum256(append([]byte(msg.Subject+"\n"), msg.Data...))
+		msg.Header.Set(nats.MsgIdHdr, hex.EncodeToString(sum[:]))
+	default:
+		msg.Header.Set(nats.MsgIdHdr, nuid.Next())
+	}
+}
+
+func (o *publishOptions) hasExpectation() bool {
+	return o.expectLastSeq != nil || o.expectLastSeqPerSubject != nil || o.expectLastMsgId != ""
+}
@@ -1,6 +1,9 @@
 package dgnats
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
@@ -10,81 +13,318 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-func Publish(ctx *dgctx.DgContext, subject *NatsSubject, obj any) error {
-	bytes, err := ToBytes(ctx, obj)
+const jsErrCodeStreamWrongLastMsgId nats.ErrorCode = 10070
+
+var (
+	ErrDuplicateMessage            = errors.New("duplicate message")
+	ErrWrongLastSequence           = errors.New("wrong last sequence")
+	ErrDelayExpectationUnsupported = errors.New("expected last sequence is not supported for delayed publish")
+)
+
+func Publish(ctx *dgctx.DgContext, subject *NatsSubject, obj any, opts ...PublishOption) error {
+	_, err := PublishWithAck(ctx, subject, obj, opts...)
+	return ignoreSpooled(err)
+}
+
+func PublishWithAck(ctx *dgctx.DgContext, subject *NatsSubject, obj any, opts ...PublishOption) (*nats.PubAck, error) {
+	bytes, header, err := encodePayload(ctx, subject, obj)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dglogger.Infof(ctx, "publish subject[%s] json message: %s", subject.Name, string(bytes))
-
-	return PublishRaw(ctx, subject, bytes)
+	return publishRawWithHeader(ctx, subject, header, bytes, withPayloadLog("publish", opts))
 }
 
-func PublishDelay(ctx *dgctx.DgContext, subject *NatsSubject, obj any, duration time.Duration) error {
-	bytes, err := ToBytes(ctx, obj)
+func PublishWithHeaders(ctx *dgctx.DgContext, subject *NatsSubject, header nats.Header, obj any, opts ...PublishOption) error {
+	bytes, codecHeader, err := encodePayload(ctx, subject, obj)
 	if err != nil {
 		return err
 	}
-	dglogger.Infof(ctx, "publish subject[%s] json delay message: %s", subject.Name, string(bytes))
+	msgHeader := copyHeader(header)
+	for key, values := range codecHeader {
+		msgHeader[key] = values
+	}
+	_, err = publishRawWithHeader(ctx, subject, msgHeader, bytes, withPayloadLog("publish", opts))
+
+	return ignoreSpooled(err)
+}
+
+func PublishDelay(ctx *dgctx.DgContext, subject *NatsSubject, obj any, duration time.Duration, opts ...PublishOption) (string, error) {
+	id, _, err := PublishDelayWithAck(ctx, subject, obj, duration, opts...)
+	return id, err
+}
+
+func PublishAt(ctx *dgctx.DgContext, subject *NatsSubject, obj any, at time.Time, opts ...PublishOption) (string, error) {
+	id, _, err := publishDelay(ctx, subject, obj, time.Now(), at, opts)
+	return id, err
+}
 
-	header := map[string][]string{
-		constants.TraceId: {ctx.TraceId},
-		headerPubAt:       {strconv.FormatInt(time.Now().UnixNano(), 10)},
-		headerDelay:       {strconv.FormatInt(int64(duration), 10)},
+func PublishDelayWithAck(ctx *dgctx.DgContext, subject *NatsSubject, obj any, duration time.Duration, opts ...PublishOption) (string, *nats.PubAck, error) {
+	now := time.Now()
+	return publishDelay(ctx, subject, obj, now, now.Add(duration), opts)
+}
+
+func publishDelay(ctx *dgctx.DgContext, subject *NatsSubject, obj any, now time.Time, dueAt time.Time, opts []PublishOption) (string, *nats.PubAck, error) {
+	bytes, header, err := encodePayload(ctx, subject, obj)
+	if err != nil {
+		return "", nil, err
 	}
+	header[constants.TraceId] = []string{ctx.TraceId}
+	header[HeaderPubAt] = []string{strconv.FormatInt(now.UnixNano(), 10)}
+	header[HeaderDelay] = []string{strconv.FormatInt(int64(dueAt.Sub(now)), 10)}
 
 	msg := &nats.Msg{
-		Subject: subject.Name,
-		Reply:   subject.Name,
+		Subject: subject.GetSubject(),
 		Header:  header,
 		Data:    bytes,
 	}
 
-	return publishMsg(ctx, subject, msg)
+	var id string
+	ack, err := chainPublish(subject, func(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+		var ack *nats.PubAck
+		var err error
+		id, ack, err = publishDelayMsg(ctx, subject, msg, dueAt, buildPublishOptions(withPayloadLog("publish delay", opts)))
+		return ack, err
+	})(ctx, subject, msg)
+
+	return id, ack, err
+}
+
+func PublishRaw(ctx *dgctx.DgContext, subject *NatsSubject, data []byte, opts ...PublishOption) error {
+	_, err := PublishRawWithAck(ctx, subject, data, opts...)
+	return ignoreSpooled(err)
+}
+
+func PublishRawWithAck(ctx *dgctx.DgContext, subject *NatsSubject, data []byte, opts ...PublishOption) (*nats.PubAck, error) {
+	return publishRawWithHeader(ctx, subject, map[string][]string{}, data, opts)
 }
 
-func PublishRaw(ctx *dgctx.DgContext, subject *NatsSubject, data []byte) error {
-	return publishRawWithHeader(ctx, subject, map[string][]string{}, data)
+func PublishRawWithHeaders(ctx *dgctx.DgContext, subject *NatsSubject, header nats.Header, data []byte, opts ...PublishOption) error {
+	_, err := publishRawWithHeader(ctx, subject, copyHeader(header), data, opts)
+	return ignoreSpooled(err)
 }
 
-func PublishRawWithTag(ctx *dgctx.DgContext, subject *NatsSubject, tag string, data []byte) error {
+func PublishRawWithTag(ctx *dgctx.DgContext, subject *NatsSubject, tag string, data []byte, opts ...PublishOption) error {
 	if tag == "" {
-		return PublishRaw(ctx, subject, data)
+		return PublishRaw(ctx, subject, data, opts...)
+	}
+
+	_, err := publishRawWithHeader(ctx, subject, map[string][]string{HeaderTag: {tag}}, data, opts)
+	return ignoreSpooled(err)
+}
+
+func publishRawWithHeader(ctx *dgctx.DgContext, subject *NatsSubject, header map[string][]string, data []byte, opts []PublishOption) (*nats.PubAck, error) {
+	return publishMsg(ctx, subject, buildRawMsg(ctx, subject, header, data), buildPublishOptions(opts))
+}
+
+func ignoreSpooled(err error) error {
+	if errors.Is(err, ErrSpooled) {
+		return nil
+	}
+
+	return err
+}
+
+func copyHeader(header nats.Header) nats.Header {
+	copied := nats.Header{}
+	for key, values := range header {
+		copied[key] = append([]string(nil), values...)
 	}
 
-	return publishRawWithHeader(ctx, subject, map[string][]string{headerTag: {tag}}, data)
+	return copied
 }
 
-func publishRawWithHeader(ctx *dgctx.DgContext, subject *NatsSubject, header map[string][]string, data []byte) error {
+func buildRawMsg(ctx *dgctx.DgContext, subject *NatsSubject, header map[string][]string, data []byte) *nats.Msg {
 	header[constants.TraceId] = []string{ctx.TraceId}
 
-	msg := &nats.Msg{
-		Subject: subject.Name,
+	return &nats.Msg{
+		Subject: subject.GetSubject(),
 		Header:  header,
 		Data:    data,
 	}
+}
 
-	return publishMsg(ctx, subject, msg)
+func publishMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (*nats.PubAck, error) {
+	return chainPublish(subject, func(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+		return sendPublishMsg(ctx, subject, msg, opts)
+	})(ctx, subject, msg)
 }
 
-func publishMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
-	err := InitStream(ctx, subject)
+func sendPublishMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (*nats.PubAck, error) {
+	if err := waitRateLimit(ctx, subject); err != nil {
+		return nil, err
+	}
+
+	// queue behind spooled messages until the spool has drained so replay keeps publish order
+	sp := natsSpool.Load()
+	queued := sp != nil && !opts.hasExpectation() && sp.pending()
+
+	js, err := preparePublishMsg(ctx, subject, msg, opts)
+	if err == nil && !queued {
+		var ack *nats.PubAck
+		ack, err = sendMsg(ctx, js, subject, msg, opts)
+		if err == nil {
+			return ack, checkDuplicate(ctx, subject, msg, ack, opts)
+		}
+	}
+
+	if sp != nil && !opts.hasExpectation() && (spoolable(err) || (queued && err == nil)) {
+		se := sp.append(ctx, subject, msg)
+		if se == nil {
+			return nil, ErrSpooled
+		}
+		dglogger.Errorf(ctx, "spool subject[%s] error: %v", subject.GetSubject(), se)
+		if err == nil {
+			err = se
+		}
+	}
+
+	return nil, err
+}
+
+func sendMsg(ctx *dgctx.DgContext, js nats.JetStreamContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (*nats.PubAck, error) {
+	breaker := getCircuitBreaker(subject.GetStream())
+	policy := opts.retryPolicy
+	recovered := false
+	start := time.Now()
+	outcomeUnknown := false
+
+	for attempt := 1; ; attempt++ {
+		err := breaker.allow()
+		if err != nil {
+			dglogger.Warnf(ctx, "publish subject[%s] rejected: %v", subject.GetSubject(), err)
+			return nil, err
+		}
+
+		var ack *nats.PubAck
+		if js == nil {
+			js, err = GetJs()
+		}
+		if err == nil {
+			ack, err = js.PublishMsg(msg, buildPubOpts(subject, opts)...)
+			err = wrapWrongLastSequence(err)
+		}
+		// the stream or subject may have been removed by another process while still cached here
+		if err != nil && !recovered && (errors.Is(err, nats.ErrNoStreamResponse) || errors.Is(err, nats.ErrStreamNotFound)) {
+			recovered = true
+			if re := recoverStream(ctx, subject); re == nil {
+				dglogger.Warnf(ctx, "publish subject[%s] recreated missing stream[%s]", subject.GetSubject(), subject.GetStream())
+				// the server answered, so the missing stream does not count against the breaker
+				breaker.record(false)
+				attempt--
+				continue
+			}
+		}
+		retryable := err != nil && policy.retryable(err)
+		breaker.record(retryable)
+		// an earlier attempt may have been stored before timing out, only then is the duplicate our own write
+		if ack != nil && ack.Duplicate && outcomeUnknown && isOwnWrite(js, ack, start) {
+			ack.Duplicate = false
+		}
+		outcomeUnknown = outcomeUnknown || errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+		if err == nil || !retryable || attempt >= policy.maxAttempts() {
+			return ack, err
+		}
+
+		dglogger.Warnf(ctx, "publish subject[%s] attempt %d error: %v", subject.GetSubject(), attempt, err)
+		if we := policy.wait(ctx, attempt); we != nil {
+			return nil, err
+		}
+		js = nil
+	}
+}
+
+func isOwnWrite(js nats.JetStreamContext, ack *nats.PubAck, start time.Time) bool {
+	raw, err := js.GetMsg(ack.Stream, ack.Sequence)
+	if err != nil {
+		return false
+	}
+
+	return !raw.Time.Before(start)
+}
+
+func preparePublishMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (nats.JetStreamContext, error) {
+	err := subject.validatePublish()
+	if err != nil {
+		dglogger.Errorf(ctx, "validate publish subject error: %v", err)
+		return nil, err
+	}
+
+	resolveMsgId(msg, opts)
+	if opts.ttl > 0 {
+		msg.Header.Set(nats.MsgTTLHdr, opts.ttl.String())
+	}
+	if opts.payloadLogAction != "" {
+		logPayload(ctx, opts.payloadLogAction, subject, msg)
+	}
+
+	err = encodeMsg(ctx, subject, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = InitStream(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Header.Get(nats.MsgTTLHdr) != "" {
+		err = enableMsgTTL(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return GetJs()
+}
+
+func encodeMsg(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
+	err := compressMsg(ctx, subject, msg)
 	if err != nil {
 		return err
 	}
 
-	js, err := GetJs()
+	err = encryptMsg(ctx, subject, msg)
 	if err != nil {
 		return err
 	}
-	_, err = js.PublishMsg(msg, buildPubOpts(subject)...)
 
-	return err
+	return claimCheckMsg(ctx, subject, msg)
 }
 
-func buildPubOpts(subject *NatsSubject) []nats.PubOpt {
-	return []nats.PubOpt{
-		nats.MsgId(nats.NewInbox()),
-		nats.ExpectStream(subject.Category),
+func checkDuplicate(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, ack *nats.PubAck, opts *publishOptions) error {
+	if !ack.Duplicate {
+		return nil
 	}
+
+	dglogger.Warnf(ctx, "publish subject[%s] duplicate message: %s", subject.GetSubject(), msg.Header.Get(nats.MsgIdHdr))
+	if opts.failOnDuplicate {
+		return ErrDuplicateMessage
+	}
+
+	return nil
+}
+
+func buildPubOpts(subject *NatsSubject, opts *publishOptions) []nats.PubOpt {
+	pubOpts := []nats.PubOpt{
+		nats.ExpectStream(subject.GetStream()),
+	}
+	if opts.expectLastSeq != nil {
+		pubOpts = append(pubOpts, nats.ExpectLastSequence(*opts.expectLastSeq))
+	}
+	if opts.expectLastSeqPerSubject != nil {
+		pubOpts = append(pubOpts, nats.ExpectLastSequencePerSubject(*opts.expectLastSeqPerSubject))
+	}
+	if opts.expectLastMsgId != "" {
+		pubOpts = append(pubOpts, nats.ExpectLastMsgId(opts.expectLastMsgId))
+	}
+
+	return pubOpts
+}
+
+func wrapWrongLastSequence(err error) error {
+	var apiErr *nats.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence || apiErr.ErrorCode == jsErrCodeStreamWrongLastMsgId) {
+		return fmt.Errorf("%w: %s", ErrWrongLastSequence, apiErr.Description)
+	}
+
+	return err
 }
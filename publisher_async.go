@@ -0,0 +1,180 @@
+package dgnats
+
+import (
+	"sync"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultPublishAsyncMaxPending = 4000
+	defaultPublishAsyncTimeout    = 30 * time.Second
+)
+
+var (
+	asyncPending = make(chan struct{}, defaultPublishAsyncMaxPending)
+	asyncTracker = &pendingTracker{}
+)
+
+type pendingTracker struct {
+	mu    sync.Mutex
+	count int
+	idle  chan struct{}
+}
+
+func (t *pendingTracker) add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+}
+
+func (t *pendingTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+	}
+}
+
+func (t *pendingTracker) wait() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.count == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+
+	return t.idle
+}
+
+type PublishFuture struct {
+	msg  *nats.Msg
+	done chan struct{}
+	ack  *nats.PubAck
+	err  error
+}
+
+func (f *PublishFuture) Msg() *nats.Msg {
+	return f.msg
+}
+
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *PublishFuture) Ack() (*nats.PubAck, error) {
+	<-f.done
+	return f.ack, f.err
+}
+
+func PublishAsync(ctx *dgctx.DgContext, subject *NatsSubject, obj any, opts ...PublishOption) (*PublishFuture, error) {
+	bytes, header, err := encodePayload(ctx, subject, obj)
+	if err != nil {
+		return nil, err
+	}
+	return publishMsgAsync(ctx, subject, buildRawMsg(ctx, subject, header, bytes), buildPublishOptions(withPayloadLog("publish async", opts)))
+}
+
+func PublishRawAsync(ctx *dgctx.DgContext, subject *NatsSubject, data []byte, opts ...PublishOption) (*PublishFuture, error) {
+	return publishMsgAsync(ctx, subject, buildRawMsg(ctx, subject, map[string][]string{}, data), buildPublishOptions(opts))
+}
+
+func WaitAllAcks(ctx *dgctx.DgContext) error {
+	done := asyncTracker.wait()
+	inner := innerContext(ctx)
+	select {
+	case <-done:
+		return nil
+	case <-inner.Done():
+		return inner.Err()
+	}
+}
+
+func publishMsgAsync(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (*PublishFuture, error) {
+	var future *PublishFuture
+	_, err := chainPublish(subject, func(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) (*nats.PubAck, error) {
+		var err error
+		future, err = sendPublishMsgAsync(ctx, subject, msg, opts)
+		return nil, err
+	})(ctx, subject, msg)
+	if err != nil {
+		return nil, err
+	}
+	if future == nil {
+		future = &PublishFuture{msg: msg, done: make(chan struct{})}
+		close(future.done)
+	}
+
+	return future, nil
+}
+
+func sendPublishMsgAsync(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg, opts *publishOptions) (*PublishFuture, error) {
+	if err := waitRateLimit(ctx, subject); err != nil {
+		return nil, err
+	}
+
+	js, err := preparePublishMsg(ctx, subject, msg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	asyncTracker.add()
+	pending := asyncPending
+	inner := innerContext(ctx)
+	select {
+	case pending <- struct{}{}:
+	case <-inner.Done():
+		asyncTracker.done()
+		return nil, inner.Err()
+	}
+
+	paf, err := js.PublishMsgAsync(msg, buildPubOpts(subject, opts)...)
+	if err != nil {
+		<-pending
+		asyncTracker.done()
+		return nil, err
+	}
+
+	future := &PublishFuture{msg: msg, done: make(chan struct{})}
+	go func() {
+		defer func() {
+			<-pending
+			asyncTracker.done()
+		}()
+
+		select {
+		case ack := <-paf.Ok():
+			future.ack = ack
+			future.err = checkDuplicate(ctx, subject, msg, ack, opts)
+		case err := <-paf.Err():
+			future.err = wrapWrongLastSequence(err)
+		}
+		close(future.done)
+
+		if future.err != nil {
+			dglogger.Errorf(ctx, "publish async subject[%s] error: %v", subject.GetSubject(), future.err)
+			if opts.asyncErrHandler != nil {
+				opts.asyncErrHandler(ctx, msg, future.err)
+			}
+		}
+	}()
+
+	return future, nil
+}
+
+func initAsyncPending(maxPending int) {
+	if maxPending > 0 {
+		asyncPending = make(chan struct{}, maxPending)
+	}
+}
@@ -0,0 +1,187 @@
+package dgnats
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+)
+
+const (
+	RateLimitBlock = "block"
+	RateLimitFail  = "fail"
+
+	rateLimitSubjectPrefix  = "subject:"
+	rateLimitCategoryPrefix = "category:"
+)
+
+var (
+	ErrRateLimited = errors.New("publish rate limited")
+
+	rateLimiters subjectRegistry[*rateLimiter]
+)
+
+type RateLimitConfig struct {
+	Rate    float64       `json:"rate" binding:"required" remark:"每秒允许发布的消息数"`
+	Burst   int           `json:"burst" remark:"突发容量, 默认为rate向上取整"`
+	Mode    string        `json:"mode" remark:"超限策略: block/fail, 默认block"`
+	MaxWait time.Duration `json:"maxWait" remark:"block策略下最长等待时间, 0为不限制"`
+}
+
+type RateLimitStats struct {
+	Allowed   uint64        `json:"allowed" remark:"直接放行的消息数"`
+	Throttled uint64        `json:"throttled" remark:"等待后放行的消息数"`
+	Rejected  uint64        `json:"rejected" remark:"被拒绝的消息数"`
+	WaitTime  time.Duration `json:"waitTime" remark:"累计等待时长"`
+}
+
+type rateLimiter struct {
+	key       func() string
+	conf      *RateLimitConfig
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	allowed   atomic.Uint64
+	throttled atomic.Uint64
+	rejected  atomic.Uint64
+	waitTime  atomic.Int64
+}
+
+func SetSubjectRateLimit(subject *NatsSubject, conf *RateLimitConfig) {
+	pinned := *subject
+	setRateLimit(rateLimitSubjectPrefix+subject.Namespace+"|"+subject.Name, conf, func() string {
+		return rateLimitSubjectPrefix + pinned.GetSubject()
+	})
+}
+
+func SetCategoryRateLimit(namespace string, category string, conf *RateLimitConfig) {
+	setRateLimit(rateLimitCategoryPrefix+namespace+"|"+category, conf, func() string {
+		return rateLimitCategoryPrefix + withNamespace(resolveNamespace(namespace), category, dash)
+	})
+}
+
+func GetRateLimitStats() map[string]RateLimitStats {
+	stats := map[string]RateLimitStats{}
+	rateLimiters.rangeEntries(func(key string, limiters []*rateLimiter) {
+		for _, limiter := range limiters {
+			stats[key] = RateLimitStats{
+				Allowed:   limiter.allowed.Load(),
+				Throttled: limiter.throttled.Load(),
+				Rejected:  limiter.rejected.Load(),
+				WaitTime:  time.Duration(limiter.waitTime.Load()),
+			}
+		}
+	})
+
+	return stats
+}
+
+func setRateLimit(id string, conf *RateLimitConfig, key func() string) {
+	if conf == nil || conf.Rate <= 0 {
+		rateLimiters.remove(id)
+		return
+	}
+
+	limiter := &rateLimiter{key: key, conf: conf, last: time.Now()}
+	limiter.tokens = limiter.burst()
+	rateLimiters.set(id, key, limiter)
+}
+
+func waitRateLimit(ctx *dgctx.DgContext, subject *NatsSubject) error {
+	limiters := slices.Concat(rateLimiters.lookup(rateLimitSubjectPrefix+subject.GetSubject(), equalKey),
+		rateLimiters.lookup(rateLimitCategoryPrefix+subject.GetStream(), equalKey))
+	if len(limiters) == 0 {
+		return nil
+	}
+
+	delays, err := reserveRateLimit(limiters)
+	if err != nil {
+		dglogger.Warnf(ctx, "publish subject[%s] rate limited: %v", subject.GetSubject(), err)
+		return err
+	}
+	delay := slices.Max(delays)
+	if delay <= 0 {
+		for _, limiter := range limiters {
+			limiter.allowed.Add(1)
+		}
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		for i, limiter := range limiters {
+			if delays[i] > 0 {
+				limiter.throttled.Add(1)
+				limiter.waitTime.Add(int64(delays[i]))
+			} else {
+				limiter.allowed.Add(1)
+			}
+		}
+		return nil
+	case <-innerContext(ctx).Done():
+		for i, limiter := range limiters {
+			limiter.mu.Lock()
+			limiter.tokens++
+			limiter.mu.Unlock()
+			if delays[i] > 0 {
+				limiter.rejected.Add(1)
+			}
+		}
+		dglogger.Warnf(ctx, "publish subject[%s] rate limited: %v", subject.GetSubject(), innerContext(ctx).Err())
+		return innerContext(ctx).Err()
+	}
+}
+
+// reserveRateLimit takes a token from every limiter only when none of them rejects
+func reserveRateLimit(limiters []*rateLimiter) ([]time.Duration, error) {
+	for _, limiter := range limiters {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+	}
+
+	now := time.Now()
+	delays := make([]time.Duration, len(limiters))
+	for i, l := range limiters {
+		l.tokens += now.Sub(l.last).Seconds() * l.conf.Rate
+		if burst := l.burst(); l.tokens > burst {
+			l.tokens = burst
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			continue
+		}
+		delays[i] = time.Duration((1 - l.tokens) / l.conf.Rate * float64(time.Second))
+		if l.conf.Mode == RateLimitFail || (l.conf.MaxWait > 0 && delays[i] > l.conf.MaxWait) {
+			l.rejected.Add(1)
+			return nil, fmt.Errorf("%w by [%s]", ErrRateLimited, l.key())
+		}
+	}
+	for _, l := range limiters {
+		l.tokens--
+	}
+
+	return delays, nil
+}
+
+func equalKey(pattern string, key string) bool {
+	return pattern == key
+}
+
+func (l *rateLimiter) burst() float64 {
+	if l.conf.Burst > 0 {
+		return float64(l.conf.Burst)
+	}
+	if l.conf.Rate < 1 {
+		return 1
+	}
+
+	return float64(int(l.conf.Rate + 0.999999))
+}
@@ -0,0 +1,89 @@
+package dgnats
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/nats-io/nats.go"
+)
+
+var DefaultPublishRetryPolicy = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int              `json:"maxAttempts" remark:"最大尝试次数, 包含首次"`
+	InitialBackoff time.Duration    `json:"initialBackoff" remark:"首次重试等待时间"`
+	MaxBackoff     time.Duration    `json:"maxBackoff" remark:"最大重试等待时间"`
+	Multiplier     float64          `json:"multiplier" remark:"等待时间增长倍数"`
+	Jitter         float64          `json:"jitter" remark:"随机抖动比例, 0~1"`
+	Retryable      func(error) bool `json:"-" remark:"可重试错误判断, 为空时使用IsRetryablePublishError"`
+}
+
+func IsRetryablePublishError(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrNoStreamResponse) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, nats.ErrConnectionClosed) ||
+		errors.Is(err, nats.ErrConnectionDraining) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, connectionFailedError) ||
+		errors.Is(err, noConnectionError)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, ErrWrongLastSequence) {
+		return false
+	}
+	if p != nil && p.Retryable != nil {
+		return p.Retryable(err)
+	}
+
+	return IsRetryablePublishError(err)
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(backoff)
+}
+
+func (p *RetryPolicy) wait(ctx *dgctx.DgContext, attempt int) error {
+	timer := time.NewTimer(p.backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-innerContext(ctx).Done():
+		return innerContext(ctx).Err()
+	}
+}
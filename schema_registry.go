@@ -0,0 +1,352 @@
+package dgnats
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dgcoll "github.com/darwinOrg/go-common/collection"
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+const (
+	SchemaCompatibilityNone     = "none"
+	SchemaCompatibilityBackward = "backward"
+	SchemaCompatibilityForward  = "forward"
+	SchemaCompatibilityFull     = "full"
+
+	schemaBucket    = "dgnats-schemas"
+	schemaLatestKey = "latest"
+	schemaResource  = "schema.json"
+)
+
+var (
+	DefaultSchemaCompatibility = SchemaCompatibilityBackward
+	SchemaCacheTTL             = 30 * time.Second
+	SchemaFailClosed           = false
+
+	ErrSchemaNotFound     = errors.New("schema not found")
+	ErrSchemaIncompatible = errors.New("schema incompatible")
+	ErrSchemaValidation   = errors.New("schema validation failed")
+
+	schemaCache           = sync.Map{}
+	schemaRegistryEnabled atomic.Bool
+)
+
+type SchemaInfo struct {
+	Subject   string    `json:"subject" remark:"subject"`
+	Version   int       `json:"version" remark:"版本号, 从1开始递增"`
+	Schema    string    `json:"schema" remark:"JSON Schema内容"`
+	CreatedAt time.Time `json:"createdAt" remark:"注册时间"`
+}
+
+type cachedSchema struct {
+	info      *SchemaInfo
+	compiled  *jsonschema.Schema
+	expiresAt time.Time
+}
+
+func EnableSchemaRegistry() {
+	schemaRegistryEnabled.Store(true)
+}
+
+func DisableSchemaRegistry() {
+	schemaRegistryEnabled.Store(false)
+	schemaCache.Clear()
+}
+
+func RegisterSchema(ctx *dgctx.DgContext, subject *NatsSubject, schema string) (int, error) {
+	if _, err := compileSchema(schema); err != nil {
+		dglogger.Errorf(ctx, "compile subject[%s] schema error: %v", subject.GetSubject(), err)
+		return 0, err
+	}
+
+	bucket, err := NewNatsBucket(schemaBucket)
+	if err != nil {
+		return 0, err
+	}
+	prefix := schemaKeyPrefix(subject.GetSubject())
+	latest, revision, err := loadLatestSchema(bucket, subject.GetSubject())
+	if err != nil && !errors.Is(err, ErrSchemaNotFound) {
+		return 0, err
+	}
+
+	version := 1
+	if latest != nil {
+		if equalSchema(latest.Schema, schema) {
+			return latest.Version, nil
+		}
+		if err = checkSchemaCompatibility(latest.Schema, schema, DefaultSchemaCompatibility); err != nil {
+			dglogger.Errorf(ctx, "register subject[%s] schema error: %v", subject.GetSubject(), err)
+			return 0, err
+		}
+		version = latest.Version + 1
+	}
+
+	info := &SchemaInfo{Subject: subject.GetSubject(), Version: version, Schema: schema, CreatedAt: time.Now()}
+	infoJson, err := utils.ConvertBeanToJsonString(info)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = bucket.Create(prefix+strconv.Itoa(version), []byte(infoJson)); err != nil {
+		return 0, err
+	}
+	if revision > 0 {
+		_, err = bucket.Update(prefix+schemaLatestKey, []byte(strconv.Itoa(version)), revision)
+	} else {
+		_, err = bucket.Create(prefix+schemaLatestKey, []byte(strconv.Itoa(version)))
+	}
+	if err != nil {
+		return 0, err
+	}
+	schemaCache.Delete(subject.GetSubject())
+	dglogger.Infof(ctx, "register subject[%s] schema version %d", subject.GetSubject(), version)
+
+	return version, nil
+}
+
+func GetSchema(ctx *dgctx.DgContext, subject *NatsSubject, version int) (*SchemaInfo, error) {
+	bucket, err := bindSchemaBucket()
+	if err != nil {
+		return nil, err
+	}
+	if version <= 0 {
+		info, _, err := loadLatestSchema(bucket, subject.GetSubject())
+		return info, err
+	}
+
+	return loadSchema(bucket, subject.GetSubject(), version)
+}
+
+func validateSchema(subject string, version int, data []byte) (int, error) {
+	if !schemaRegistryEnabled.Load() {
+		return 0, nil
+	}
+	cached, err := getCachedSchema(subject, version)
+	if err != nil || cached == nil {
+		return 0, err
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSchemaValidation, err)
+	}
+	if err = cached.compiled.Validate(instance); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSchemaValidation, err)
+	}
+
+	return cached.info.Version, nil
+}
+
+func getCachedSchema(subject string, version int) (*cachedSchema, error) {
+	key := subject
+	if version > 0 {
+		key = subject + "@" + strconv.Itoa(version)
+	}
+	if value, ok := schemaCache.Load(key); ok {
+		cached := value.(*cachedSchema)
+		if cached.info != nil && version > 0 {
+			return cached, nil
+		}
+		if time.Now().Before(cached.expiresAt) {
+			return utils.IfReturn(cached.info != nil, cached, nil), nil
+		}
+	}
+
+	cached := &cachedSchema{expiresAt: time.Now().Add(SchemaCacheTTL)}
+	info, err := lookupSchema(subject, version)
+	if err == nil {
+		cached.info = info
+		cached.compiled, err = compileSchema(info.Schema)
+	}
+	if errors.Is(err, ErrSchemaNotFound) {
+		schemaCache.Store(key, &cachedSchema{expiresAt: cached.expiresAt})
+		return nil, nil
+	}
+	// other lookup errors are not cached so validation keeps failing closed until the registry recovers
+	if err != nil {
+		return nil, err
+	}
+	schemaCache.Store(key, cached)
+
+	return cached, nil
+}
+
+func lookupSchema(subject string, version int) (*SchemaInfo, error) {
+	bucket, err := bindSchemaBucket()
+	if err != nil {
+		return nil, err
+	}
+	if version > 0 {
+		return loadSchema(bucket, subject, version)
+	}
+	info, _, err := loadLatestSchema(bucket, subject)
+
+	return info, err
+}
+
+func bindSchemaBucket() (*NatsBucket, error) {
+	js, err := GetJs()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(withNamespace(resolveNamespace(""), schemaBucket, dash))
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return nil, ErrSchemaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &NatsBucket{kv}, nil
+}
+
+func loadLatestSchema(bucket *NatsBucket, subject string) (*SchemaInfo, uint64, error) {
+	value, revision, err := bucket.Get(schemaKeyPrefix(subject) + schemaLatestKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, ErrSchemaNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := strconv.Atoi(string(value))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := loadSchema(bucket, subject, version)
+
+	return info, revision, err
+}
+
+func loadSchema(bucket *NatsBucket, subject string, version int) (*SchemaInfo, error) {
+	value, _, err := bucket.Get(schemaKeyPrefix(subject) + strconv.Itoa(version))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, ErrSchemaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.ConvertJsonBytesToBean[SchemaInfo](value)
+}
+
+func compileSchema(schema string) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader([]byte(schema)))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err = compiler.AddResource(schemaResource, doc); err != nil {
+		return nil, err
+	}
+
+	return compiler.Compile(schemaResource)
+}
+
+func checkSchemaCompatibility(oldSchema string, newSchema string, compatibility string) error {
+	var oldDoc, newDoc map[string]any
+	if err := json.Unmarshal([]byte(oldSchema), &oldDoc); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(newSchema), &newDoc); err != nil {
+		return err
+	}
+
+	var reason string
+	switch compatibility {
+	case SchemaCompatibilityBackward:
+		reason = schemaReadable(newDoc, oldDoc, "$")
+	case SchemaCompatibilityForward:
+		reason = schemaReadable(oldDoc, newDoc, "$")
+	case SchemaCompatibilityFull:
+		reason = schemaReadable(newDoc, oldDoc, "$")
+		if reason == "" {
+			reason = schemaReadable(oldDoc, newDoc, "$")
+		}
+	}
+	if reason != "" {
+		return fmt.Errorf("%w: %s", ErrSchemaIncompatible, reason)
+	}
+
+	return nil
+}
+
+func schemaReadable(reader map[string]any, writer map[string]any, path string) string {
+	if readerType, ok := reader["type"]; ok {
+		if writerType, ok := writer["type"]; !ok || !reflect.DeepEqual(readerType, writerType) {
+			return fmt.Sprintf("%s type changed from %v to %v", path, writer["type"], readerType)
+		}
+	}
+
+	writerRequired := schemaStrings(writer["required"])
+	for _, required := range schemaStrings(reader["required"]) {
+		if !dgcoll.Contains(writerRequired, required) {
+			return fmt.Sprintf("%s.%s is required but may be missing", path, required)
+		}
+	}
+
+	readerProperties, _ := reader["properties"].(map[string]any)
+	writerProperties, _ := writer["properties"].(map[string]any)
+	for name, readerProperty := range readerProperties {
+		writerProperty, ok := writerProperties[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		if rp, ok := readerProperty.(map[string]any); ok {
+			if reason := schemaReadable(rp, writerProperty, path+"."+name); reason != "" {
+				return reason
+			}
+		}
+	}
+	if additional, ok := reader["additionalProperties"].(bool); ok && !additional {
+		for name := range writerProperties {
+			if _, ok := readerProperties[name]; !ok {
+				return fmt.Sprintf("%s.%s is not allowed", path, name)
+			}
+		}
+	}
+
+	if readerItems, ok := reader["items"].(map[string]any); ok {
+		if writerItems, ok := writer["items"].(map[string]any); ok {
+			return schemaReadable(readerItems, writerItems, path+"[]")
+		}
+	}
+
+	return ""
+}
+
+func schemaStrings(value any) []string {
+	values, _ := value.([]any)
+	var strs []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+
+	return strs
+}
+
+func equalSchema(a string, b string) bool {
+	var docA, docB any
+	if json.Unmarshal([]byte(a), &docA) != nil || json.Unmarshal([]byte(b), &docB) != nil {
+		return a == b
+	}
+
+	return reflect.DeepEqual(docA, docB)
+}
+
+func schemaKeyPrefix(subject string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(subject)) + dot
+}
@@ -0,0 +1,440 @@
+package dgnats
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/darwinOrg/go-common/constants"
+	dgctx "github.com/darwinOrg/go-common/context"
+	"github.com/darwinOrg/go-common/utils"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	SpoolFsyncAlways   = "always"
+	SpoolFsyncInterval = "interval"
+	SpoolFsyncNever    = "never"
+
+	spoolWalFile    = "spool.wal"
+	spoolOffsetFile = "spool.offset"
+
+	// each record is prefixed with its length and crc32 checksum
+	spoolRecordHeaderSize = 8
+
+	defaultSpoolMaxBytes        = 256 << 20
+	defaultSpoolFsyncInterval   = time.Second
+	defaultSpoolForwardInterval = time.Second
+)
+
+var (
+	ErrSpoolFull = errors.New("spool is full")
+	ErrSpooled   = errors.New("message spooled for later delivery")
+
+	errCorruptSpoolRecord = errors.New("corrupt spool record")
+
+	natsSpool atomic.Pointer[spool]
+)
+
+type SpoolConfig struct {
+	Dir             string        `json:"dir" binding:"required" remark:"本地存储目录"`
+	MaxBytes        int64         `json:"maxBytes" remark:"最大存储字节数, 默认256M"`
+	FsyncPolicy     string        `json:"fsyncPolicy" remark:"刷盘策略: always/interval/never, 默认interval"`
+	FsyncInterval   time.Duration `json:"fsyncInterval" remark:"interval策略下的刷盘间隔"`
+	ForwardInterval time.Duration `json:"forwardInterval" remark:"转发重试间隔"`
+}
+
+type SpoolStats struct {
+	Spooled      uint64 `json:"spooled" remark:"写入本地的消息数"`
+	Forwarded    uint64 `json:"forwarded" remark:"已转发的消息数"`
+	Rejected     uint64 `json:"rejected" remark:"因容量不足拒绝的消息数"`
+	Dropped      uint64 `json:"dropped" remark:"转发时不可重试错误丢弃的消息数"`
+	PendingBytes int64  `json:"pendingBytes" remark:"待转发字节数"`
+}
+
+type spool struct {
+	conf       *SpoolConfig
+	mu         sync.Mutex
+	wal        *os.File
+	size       int64
+	offset     int64
+	dirty      bool
+	stats      SpoolStats
+	stopCh     chan struct{}
+	doneCh     chan struct{}
+	forwardMu  sync.Mutex
+	forwardSig chan struct{}
+}
+
+type spoolRecord struct {
+	Subject *NatsSubject        `json:"subject"`
+	Header  map[string][]string `json:"header"`
+	Data    []byte              `json:"data"`
+}
+
+func EnableSpool(conf *SpoolConfig) error {
+	if natsSpool.Load() != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(conf.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(filepath.Join(conf.Dir, spoolWalFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		_ = wal.Close()
+		return err
+	}
+
+	s := &spool{
+		conf:       conf,
+		wal:        wal,
+		size:       info.Size(),
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+		forwardSig: make(chan struct{}, 1),
+	}
+	s.offset = s.readOffset()
+	if err = s.recover(&dgctx.DgContext{TraceId: nuid.Next()}); err != nil {
+		_ = wal.Close()
+		return err
+	}
+	if !natsSpool.CompareAndSwap(nil, s) {
+		_ = wal.Close()
+		return nil
+	}
+	go s.run()
+
+	return nil
+}
+
+func GetSpoolStats() SpoolStats {
+	s := natsSpool.Load()
+	if s == nil {
+		return SpoolStats{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SpoolStats{
+		Spooled:      atomic.LoadUint64(&s.stats.Spooled),
+		Forwarded:    atomic.LoadUint64(&s.stats.Forwarded),
+		Rejected:     atomic.LoadUint64(&s.stats.Rejected),
+		Dropped:      atomic.LoadUint64(&s.stats.Dropped),
+		PendingBytes: s.size - s.offset,
+	}
+}
+
+func closeSpool() {
+	s := natsSpool.Swap(nil)
+	if s == nil {
+		return
+	}
+
+	close(s.stopCh)
+	<-s.doneCh
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.wal.Sync()
+	_ = s.wal.Close()
+}
+
+func (s *spool) append(ctx *dgctx.DgContext, subject *NatsSubject, msg *nats.Msg) error {
+	data, err := json.Marshal(&spoolRecord{Subject: subject, Header: msg.Header, Data: msg.Data})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size-s.offset+int64(len(data))+spoolRecordHeaderSize > s.maxBytes() {
+		atomic.AddUint64(&s.stats.Rejected, 1)
+		return ErrSpoolFull
+	}
+
+	buf := make([]byte, spoolRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	copy(buf[spoolRecordHeaderSize:], data)
+	if _, err = s.wal.Write(buf); err != nil {
+		return err
+	}
+	s.size += int64(len(buf))
+	s.dirty = true
+	if s.conf.FsyncPolicy == SpoolFsyncAlways {
+		if err = s.syncLocked(); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&s.stats.Spooled, 1)
+	dglogger.Warnf(ctx, "spool subject[%s] message: %s", subject.GetSubject(), msg.Header.Get(nats.MsgIdHdr))
+
+	select {
+	case s.forwardSig <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset < s.size
+}
+
+func (s *spool) run() {
+	defer close(s.doneCh)
+
+	forwardTicker := time.NewTicker(utils.IfReturn(s.conf.ForwardInterval > 0, s.conf.ForwardInterval, defaultSpoolForwardInterval))
+	defer forwardTicker.Stop()
+	fsyncTicker := time.NewTicker(utils.IfReturn(s.conf.FsyncInterval > 0, s.conf.FsyncInterval, defaultSpoolFsyncInterval))
+	defer fsyncTicker.Stop()
+
+	ctx := &dgctx.DgContext{TraceId: nuid.Next()}
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-fsyncTicker.C:
+			if s.conf.FsyncPolicy != SpoolFsyncNever {
+				s.mu.Lock()
+				_ = s.syncLocked()
+				s.mu.Unlock()
+			}
+		case <-forwardTicker.C:
+			s.forward(ctx)
+		case <-s.forwardSig:
+			s.forward(ctx)
+		}
+	}
+}
+
+func (s *spool) forward(ctx *dgctx.DgContext) {
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+
+	s.mu.Lock()
+	offset, size := s.offset, s.size
+	s.mu.Unlock()
+	if offset >= size {
+		return
+	}
+
+	reader, err := os.Open(s.wal.Name())
+	if err != nil {
+		dglogger.Errorf(ctx, "open spool error: %v", err)
+		return
+	}
+	defer func() { _ = reader.Close() }()
+	if _, err = reader.Seek(offset, io.SeekStart); err != nil {
+		dglogger.Errorf(ctx, "seek spool error: %v", err)
+		return
+	}
+
+	br := bufio.NewReader(reader)
+	for offset < size {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		data, err := readSpoolRecord(br, s.maxBytes())
+		if errors.Is(err, errCorruptSpoolRecord) || errors.Is(err, io.EOF) {
+			dglogger.Errorf(ctx, "truncate spool at corrupt record[%d]", offset)
+			s.truncate(ctx, offset)
+			return
+		}
+		if err != nil {
+			dglogger.Errorf(ctx, "read spool error: %v", err)
+			return
+		}
+
+		err = s.replay(data)
+		if err != nil && spoolable(err) {
+			return
+		}
+		if err != nil {
+			atomic.AddUint64(&s.stats.Dropped, 1)
+			dglogger.Errorf(ctx, "drop spooled message error: %v", err)
+		} else {
+			atomic.AddUint64(&s.stats.Forwarded, 1)
+		}
+
+		offset += int64(spoolRecordHeaderSize + len(data))
+		s.commitOffset(ctx, offset)
+	}
+}
+
+// recover truncates a torn or corrupt tail left by a crash and aligns the offset to a record boundary
+func (s *spool) recover(ctx *dgctx.DgContext) error {
+	reader, err := os.Open(s.wal.Name())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+
+	br := bufio.NewReader(reader)
+	var size, boundary int64
+	for {
+		data, err := readSpoolRecord(br, s.maxBytes())
+		if errors.Is(err, io.EOF) || errors.Is(err, errCorruptSpoolRecord) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size += int64(spoolRecordHeaderSize + len(data))
+		if size <= s.offset {
+			boundary = size
+		}
+	}
+
+	if size < s.size {
+		dglogger.Warnf(ctx, "truncate spool from %d to %d bytes", s.size, size)
+		if err = s.wal.Truncate(size); err != nil {
+			return err
+		}
+		s.size = size
+	}
+	s.offset = boundary
+
+	return nil
+}
+
+func readSpoolRecord(r io.Reader, maxBytes int64) ([]byte, error) {
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptSpoolRecord
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || int64(size) > maxBytes {
+		return nil, errCorruptSpoolRecord
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptSpoolRecord
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorruptSpoolRecord
+	}
+
+	return data, nil
+}
+
+func (s *spool) truncate(ctx *dgctx.DgContext, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.wal.Truncate(offset); err != nil {
+		dglogger.Errorf(ctx, "truncate spool error: %v", err)
+		return
+	}
+	s.size = offset
+}
+
+func (s *spool) maxBytes() int64 {
+	return utils.IfReturn(s.conf.MaxBytes > 0, s.conf.MaxBytes, defaultSpoolMaxBytes)
+}
+
+// an open breaker means the outage is still ongoing, so the message is kept for later
+func spoolable(err error) bool {
+	return IsRetryablePublishError(err) || errors.Is(err, ErrCircuitOpen)
+}
+
+func (s *spool) replay(data []byte) error {
+	var record spoolRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	ctx := &dgctx.DgContext{TraceId: nuid.Next()}
+	if traceIds := record.Header[constants.TraceId]; len(traceIds) > 0 && traceIds[0] != "" {
+		ctx.TraceId = traceIds[0]
+	}
+	msg := &nats.Msg{
+		Subject: record.Subject.GetSubject(),
+		Header:  record.Header,
+		Data:    record.Data,
+	}
+	opts := buildPublishOptions(nil)
+
+	js, err := preparePublishMsg(ctx, record.Subject, msg, opts)
+	if err != nil {
+		return err
+	}
+	_, err = sendMsg(ctx, js, record.Subject, msg, opts)
+
+	return err
+}
+
+func (s *spool) commitOffset(ctx *dgctx.DgContext, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset = offset
+	if s.offset >= s.size {
+		if err := s.wal.Truncate(0); err != nil {
+			dglogger.Errorf(ctx, "truncate spool error: %v", err)
+		} else {
+			s.offset, s.size = 0, 0
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(s.offset))
+	err := os.WriteFile(filepath.Join(s.conf.Dir, spoolOffsetFile), buf, 0o644)
+	if err != nil {
+		dglogger.Errorf(ctx, "write spool offset error: %v", err)
+	}
+}
+
+func (s *spool) readOffset() int64 {
+	buf, err := os.ReadFile(filepath.Join(s.conf.Dir, spoolOffsetFile))
+	if err != nil || len(buf) != 8 {
+		return 0
+	}
+
+	offset := int64(binary.BigEndian.Uint64(buf))
+	if offset > s.size {
+		return 0
+	}
+
+	return offset
+}
+
+func (s *spool) syncLocked() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+
+	return s.wal.Sync()
+}
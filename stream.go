@@ -13,11 +13,20 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-var streamCache = sync.Map{}
+var (
+	streamCache          = sync.Map{}
+	msgTTLStreams        = sync.Map{}
+	ErrLastStreamSubject = errors.New("cannot remove the last subject of a stream without purge")
+)
 
 const defaultMaxAge = 31 * 24 * time.Hour
 
 func InitStream(ctx *dgctx.DgContext, subject *NatsSubject) error {
+	if err := subject.Validate(); err != nil {
+		dglogger.Errorf(ctx, "validate subject error: %v", err)
+		return err
+	}
+
 	subjectId := subject.GetId()
 	if _, ok := streamCache.Load(subjectId); ok {
 		return nil
@@ -27,32 +36,40 @@ func InitStream(ctx *dgctx.DgContext, subject *NatsSubject) error {
 	if err != nil {
 		return err
 	}
-	streamInfo, _ := js.StreamInfo(subject.Category)
+	streamInfo, _ := js.StreamInfo(subject.GetStream())
 	defer func() {
 		streamCache.Store(subjectId, streamInfo)
 	}()
 
 	if streamInfo != nil {
-		if dgcoll.AnyMatch(streamInfo.Config.Subjects, func(s string) bool {
-			return s == subject.Name
+		needUpdate := false
+		if !dgcoll.AnyMatch(streamInfo.Config.Subjects, func(s string) bool {
+			return s == subject.GetSubject()
 		}) {
+			streamInfo.Config.Subjects = append(streamInfo.Config.Subjects, subject.GetSubject())
+			needUpdate = true
+		}
+		if subject.DuplicateWindow > 0 && streamInfo.Config.Duplicates != subject.DuplicateWindow {
+			streamInfo.Config.Duplicates = subject.DuplicateWindow
+			needUpdate = true
+		}
+		if !needUpdate {
 			return nil
 		}
-		dglogger.Debugf(ctx, "update stream[%s] for %s", subject.Category, subject.Name)
+		dglogger.Debugf(ctx, "update stream[%s] for %s", subject.GetStream(), subject.GetSubject())
 
-		streamInfo.Config.Subjects = append(streamInfo.Config.Subjects, subject.Name)
 		_, err = js.UpdateStream(&streamInfo.Config)
 		if err != nil {
 			return err
 		}
 	} else {
-		dglogger.Debugf(ctx, "add stream %s", subject.Category)
+		dglogger.Debugf(ctx, "add stream %s", subject.GetStream())
 		si, err := js.AddStream(buildStreamConfig(subject))
 		if err != nil {
 			if errors.Is(err, nats.ErrStreamNameAlreadyInUse) || strings.Contains(err.Error(), "existing") {
 				return nil
 			} else {
-				dglogger.Errorf(ctx, "add stream[%s] error: %v", subject.Category, err)
+				dglogger.Errorf(ctx, "add stream[%s] error: %v", subject.GetStream(), err)
 				return err
 			}
 		}
@@ -62,31 +79,152 @@ func InitStream(ctx *dgctx.DgContext, subject *NatsSubject) error {
 	return nil
 }
 
+func recoverStream(ctx *dgctx.DgContext, subject *NatsSubject) error {
+	if subject.Category == delayCategory {
+		delayStreamCache.Delete(subject.GetNamespace())
+		_, err := ensureDelayStream(ctx, subject.GetNamespace())
+		return err
+	}
+
+	streamCache.Delete(subject.GetId())
+	msgTTLStreams.Delete(subject.GetStream())
+
+	return InitStream(ctx, subject)
+}
+
+func enableMsgTTL(ctx *dgctx.DgContext, subject *NatsSubject) error {
+	if _, ok := msgTTLStreams.Load(subject.GetStream()); ok {
+		return nil
+	}
+
+	js, err := GetJs()
+	if err != nil {
+		return err
+	}
+	streamInfo, err := js.StreamInfo(subject.GetStream())
+	if err != nil {
+		dglogger.Errorf(ctx, "get stream[%s] info error: %v", subject.GetStream(), err)
+		return err
+	}
+	if !streamInfo.Config.AllowMsgTTL {
+		dglogger.Debugf(ctx, "update stream[%s] to allow msg ttl", subject.GetStream())
+		streamInfo.Config.AllowMsgTTL = true
+		_, err = js.UpdateStream(&streamInfo.Config)
+		if err != nil {
+			dglogger.Errorf(ctx, "update stream[%s] error: %v", subject.GetStream(), err)
+			return err
+		}
+		invalidateStreamCache(subject.GetStream())
+	}
+	msgTTLStreams.Store(subject.GetStream(), true)
+
+	return nil
+}
+
 func DeleteStream(ctx *dgctx.DgContext, subject *NatsSubject) error {
 	js, err := GetJs()
 	if err != nil {
 		return err
 	}
-	err = js.DeleteStream(subject.Category)
+	err = js.DeleteStream(subject.GetStream())
 	if err != nil {
-		dglogger.Errorf(ctx, "delete stream[%s] error: %v", subject.Category, err)
+		dglogger.Errorf(ctx, "delete stream[%s] error: %v", subject.GetStream(), err)
 		return err
 	}
 
-	subjectId := subject.GetId()
-	if _, ok := streamCache.Load(subjectId); !ok {
+	invalidateStreamCache(subject.GetStream())
+	deleteClaimCheckBucket(js, subject.GetStream())
+
+	return nil
+}
+
+func RemoveSubject(ctx *dgctx.DgContext, subject *NatsSubject, purge bool) error {
+	js, err := GetJs()
+	if err != nil {
+		return err
+	}
+
+	return removeStreamSubject(ctx, js, subject.GetStream(), subject.GetSubject(), purge)
+}
+
+func removeStreamSubject(ctx *dgctx.DgContext, js nats.JetStreamContext, stream string, subject string, purge bool) error {
+	defer invalidateStreamCache(stream)
+
+	streamInfo, err := js.StreamInfo(stream)
+	if err != nil {
+		dglogger.Errorf(ctx, "get stream[%s] info error: %v", stream, err)
+		return err
+	}
+
+	subjects := dgcoll.FilterList(streamInfo.Config.Subjects, func(s string) bool {
+		return s != subject
+	})
+	if len(subjects) == 0 && !purge {
+		return ErrLastStreamSubject
+	}
+
+	if purge {
+		err = js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: subject})
+		if err != nil {
+			dglogger.Errorf(ctx, "purge stream[%s] subject[%s] error: %v", stream, subject, err)
+			return err
+		}
+	}
+
+	for ci := range js.Consumers(stream) {
+		if ci.Config.FilterSubject != subject && !dgcoll.Contains(ci.Config.FilterSubjects, subject) {
+			continue
+		}
+		dglogger.Debugf(ctx, "delete consumer[%s] of stream[%s] for %s", ci.Name, stream, subject)
+
+		err = js.DeleteConsumer(stream, ci.Name)
+		if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+			dglogger.Errorf(ctx, "delete consumer[%s] error: %v", ci.Name, err)
+			return err
+		}
+	}
+
+	if len(subjects) == len(streamInfo.Config.Subjects) {
 		return nil
 	}
-	streamCache.Delete(subjectId)
 
-	return nil
+	if len(subjects) == 0 {
+		dglogger.Debugf(ctx, "delete stream[%s] for last subject %s", stream, subject)
+		err = js.DeleteStream(stream)
+		if err != nil {
+			dglogger.Errorf(ctx, "delete stream[%s] error: %v", stream, err)
+			return err
+		}
+		deleteClaimCheckBucket(js, stream)
+		return nil
+	}
+
+	dglogger.Debugf(ctx, "update stream[%s] without %s", stream, subject)
+	streamInfo.Config.Subjects = subjects
+	_, err = js.UpdateStream(&streamInfo.Config)
+	if err != nil {
+		dglogger.Errorf(ctx, "update stream[%s] error: %v", stream, err)
+	}
+
+	return err
+}
+
+func invalidateStreamCache(stream string) {
+	msgTTLStreams.Delete(stream)
+	streamCache.Range(func(key, value any) bool {
+		if si, ok := value.(*nats.StreamInfo); !ok || si == nil || si.Config.Name == stream {
+			streamCache.Delete(key)
+		}
+		return true
+	})
 }
 
 func buildStreamConfig(subject *NatsSubject) *nats.StreamConfig {
 	return &nats.StreamConfig{
-		Name:     subject.Category,
-		Subjects: []string{subject.Name},
-		Storage:  nats.FileStorage,
-		MaxAge:   utils.IfReturn(subject.MaxAge > 0, subject.MaxAge, defaultMaxAge),
+		Name:       subject.GetStream(),
+		Subjects:   []string{subject.GetSubject()},
+		Storage:    nats.FileStorage,
+		MaxAge:     utils.IfReturn(subject.MaxAge > 0, subject.MaxAge, defaultMaxAge),
+		Duplicates: subject.DuplicateWindow,
 	}
 }
@@ -0,0 +1,196 @@
+package dgnats
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	dgcoll "github.com/darwinOrg/go-common/collection"
+	dgctx "github.com/darwinOrg/go-common/context"
+	dglogger "github.com/darwinOrg/go-logger"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultSubjectGCInterval    = time.Hour
+	defaultSubjectGCIdleTimeout = 7 * 24 * time.Hour
+)
+
+type SubjectGCConfig struct {
+	Namespace   string        `json:"namespace" remark:"命名空间, 规则同NatsSubject"`
+	Categories  []string      `json:"categories" remark:"需要回收的流, 为空时扫描命名空间下的全部流"`
+	Interval    time.Duration `json:"interval" remark:"扫描间隔"`
+	IdleTimeout time.Duration `json:"idleTimeout" remark:"无消息且无消费者持续多久后移除"`
+}
+
+type subjectGC struct {
+	conf      *SubjectGCConfig
+	idleSince map[string]time.Time
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+}
+
+func StartSubjectGC(ctx *dgctx.DgContext, conf *SubjectGCConfig) (stop func()) {
+	if ctx == nil {
+		ctx = dgctx.SimpleDgContext()
+	}
+
+	gc := &subjectGC{
+		conf:      conf,
+		idleSince: map[string]time.Time{},
+		stopCh:    make(chan struct{}),
+	}
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = defaultSubjectGCInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			gc.collect(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-gc.stopCh:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		gc.stopOnce.Do(func() { close(gc.stopCh) })
+	}
+}
+
+func (gc *subjectGC) collect(ctx *dgctx.DgContext) {
+	js, err := GetJs()
+	if err != nil {
+		dglogger.Errorf(ctx, "subject gc get jet stream error: %v", err)
+		return
+	}
+
+	idleTimeout := gc.conf.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultSubjectGCIdleTimeout
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+
+	for _, stream := range gc.streams(js) {
+		streamInfo, err := js.StreamInfo(stream)
+		if err != nil {
+			dglogger.Errorf(ctx, "subject gc get stream[%s] info error: %v", stream, err)
+			continue
+		}
+		if len(streamInfo.Config.Subjects) <= 1 {
+			continue
+		}
+		streamInfo, err = js.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: ">"})
+		if err != nil {
+			dglogger.Errorf(ctx, "subject gc get stream[%s] subjects error: %v", stream, err)
+			continue
+		}
+
+		var filters []string
+		for ci := range js.Consumers(stream) {
+			if len(ci.Config.FilterSubjects) > 0 {
+				filters = append(filters, ci.Config.FilterSubjects...)
+			} else {
+				filters = append(filters, ci.Config.FilterSubject)
+			}
+		}
+
+		remaining := len(streamInfo.Config.Subjects)
+		for _, subject := range streamInfo.Config.Subjects {
+			if hasSubjectMessages(streamInfo.State.Subjects, subject) || hasSubjectConsumers(filters, subject) {
+				continue
+			}
+
+			key := stream + " " + subject
+			seen[key] = true
+			idleSince, ok := gc.idleSince[key]
+			if !ok {
+				gc.idleSince[key] = now
+				continue
+			}
+			if now.Sub(idleSince) < idleTimeout || remaining <= 1 {
+				continue
+			}
+
+			dglogger.Infof(ctx, "subject gc remove idle subject[%s] from stream[%s]", subject, stream)
+			if err := removeStreamSubject(ctx, js, stream, subject, false); err != nil {
+				dglogger.Errorf(ctx, "subject gc remove subject[%s] error: %v", subject, err)
+				continue
+			}
+			delete(gc.idleSince, key)
+			remaining--
+		}
+	}
+
+	for key := range gc.idleSince {
+		if !seen[key] {
+			delete(gc.idleSince, key)
+		}
+	}
+}
+
+func (gc *subjectGC) streams(js nats.JetStreamContext) []string {
+	namespace := resolveNamespace(gc.conf.Namespace)
+	if len(gc.conf.Categories) > 0 {
+		return dgcoll.MapToList(gc.conf.Categories, func(category string) string {
+			return withNamespace(namespace, category, dash)
+		})
+	}
+
+	var streams []string
+	for stream := range js.StreamNames() {
+		if strings.HasPrefix(stream, "KV_") || strings.HasPrefix(stream, "OBJ_") ||
+			stream == delayCategory || strings.HasSuffix(stream, dash+delayCategory) {
+			continue
+		}
+		if namespace != "" && !strings.HasPrefix(stream, namespace+dash) {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams
+}
+
+func hasSubjectMessages(counts map[string]uint64, subject string) bool {
+	for s, count := range counts {
+		if count > 0 && subjectMatches(subject, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasSubjectConsumers(filters []string, subject string) bool {
+	return dgcoll.AnyMatch(filters, func(filter string) bool {
+		return filter == "" || subjectMatches(filter, subject) || subjectMatches(subject, filter)
+	})
+}
+
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, dot)
+	subjectTokens := strings.Split(subject, dot)
+
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(subjectTokens)
+}
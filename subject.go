@@ -1,8 +1,14 @@
 package dgnats
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/darwinOrg/go-common/utils"
 )
@@ -10,16 +16,73 @@ import (
 const (
 	illegalRegexStr = "[.|*>]"
 	dash            = "-"
+	dot             = "."
+	NoNamespace     = "-"
 )
 
-var illegalRegex = regexp.MustCompile(illegalRegexStr)
+var (
+	illegalRegex = regexp.MustCompile(illegalRegexStr)
+
+	ErrInvalidStreamName  = errors.New("invalid stream name")
+	ErrInvalidSubjectName = errors.New("invalid subject name")
+	ErrInvalidQueueName   = errors.New("invalid queue name")
+	ErrInvalidDurableName = errors.New("invalid durable name")
+)
+
+type SubjectValidationError struct {
+	Field  string
+	Value  string
+	Reason string
+	Err    error
+}
+
+func (e *SubjectValidationError) Error() string {
+	return fmt.Sprintf("%v: %s %q %s", e.Err, e.Field, e.Value, e.Reason)
+}
+
+func (e *SubjectValidationError) Unwrap() error {
+	return e.Err
+}
 
 type NatsSubject struct {
+	Namespace          string        `json:"namespace" remark:"命名空间, 为空时使用连接配置, 为-时不加前缀"`
 	Category           string        `json:"category" binding:"required" remark:"流/topic"`
 	Name               string        `json:"name" binding:"required" remark:"tag"`
 	Group              string        `json:"group" remark:"队列"`
 	MaxAge             time.Duration `json:"maxAge" remark:"最大时长"`
 	MaxAckPendingCount int           `json:"maxAckPendingCount" remark:"未被确认的最多未发送消息数"`
+	DuplicateWindow    time.Duration `json:"duplicateWindow" remark:"消息去重窗口"`
+	Codec              string        `json:"codec" remark:"编解码的content-type, 为空时使用全局默认codec"`
+	Compression        string        `json:"compression" remark:"压缩算法: gzip/zstd/s2, 为空时不压缩"`
+	CompressThreshold  int           `json:"compressThreshold" remark:"压缩阈值字节数, 小于该值不压缩, 默认1024"`
+	Encrypt            bool          `json:"encrypt" remark:"是否加密消息内容, 需先EnableEncryption"`
+	StaleAfter         time.Duration `json:"staleAfter" remark:"消费时超过该时长的消息直接确认丢弃, 0为不限制"`
+}
+
+func (s *NatsSubject) InNamespace(namespace string) *NatsSubject {
+	ns := *s
+	ns.Namespace = utils.IfReturn(namespace == "", NoNamespace, namespace)
+	return &ns
+}
+
+func (s *NatsSubject) GetNamespace() string {
+	return resolveNamespace(s.Namespace)
+}
+
+func (s *NatsSubject) GetStream() string {
+	return withNamespace(s.GetNamespace(), s.Category, dash)
+}
+
+func (s *NatsSubject) GetSubject() string {
+	return withNamespace(s.GetNamespace(), s.Name, dot)
+}
+
+func (s *NatsSubject) GetQueue() string {
+	if s.Group == "" {
+		return ""
+	}
+
+	return withNamespace(s.GetNamespace(), s.Group, dash)
 }
 
 func (s *NatsSubject) GetId() string {
@@ -28,7 +91,7 @@ func (s *NatsSubject) GetId() string {
 		id = id + "-" + s.Group
 	}
 
-	return ReplaceIllegalCharacter(id)
+	return ReplaceIllegalCharacter(withNamespace(s.GetNamespace(), id, dash))
 }
 
 func (s *NatsSubject) GetDurable(tag string) string {
@@ -39,6 +102,205 @@ func (s *NatsSubject) GetDurable(tag string) string {
 	return ""
 }
 
+func (s *NatsSubject) Validate() error {
+	if s == nil {
+		return &SubjectValidationError{Field: "subject", Reason: "is nil", Err: ErrInvalidSubjectName}
+	}
+	if s.Category == "" {
+		return &SubjectValidationError{Field: "category", Reason: "is required", Err: ErrInvalidStreamName}
+	}
+	if s.Name == "" {
+		return &SubjectValidationError{Field: "name", Reason: "is required", Err: ErrInvalidSubjectName}
+	}
+	if reason := checkName(s.GetNamespace()); reason != "" {
+		return &SubjectValidationError{Field: "namespace", Value: s.Namespace, Reason: reason, Err: ErrInvalidStreamName}
+	}
+	if reason := checkName(s.GetStream()); reason != "" {
+		return &SubjectValidationError{Field: "category", Value: s.Category, Reason: reason, Err: ErrInvalidStreamName}
+	}
+	if reason := checkSubject(s.GetSubject()); reason != "" {
+		return &SubjectValidationError{Field: "name", Value: s.Name, Reason: reason, Err: ErrInvalidSubjectName}
+	}
+	if reason := checkQueue(s.GetQueue()); reason != "" {
+		return &SubjectValidationError{Field: "group", Value: s.Group, Reason: reason, Err: ErrInvalidQueueName}
+	}
+
+	return nil
+}
+
+func (s *NatsSubject) validatePublish() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(s.GetSubject(), "*>") {
+		return &SubjectValidationError{Field: "name", Value: s.Name, Reason: "must not contain wildcards when publishing", Err: ErrInvalidSubjectName}
+	}
+
+	return nil
+}
+
+func (s *NatsSubject) validateSubscribe(tag string) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if durable := s.GetDurable(tag); durable != "" {
+		if reason := checkName(durable); reason != "" {
+			return &SubjectValidationError{Field: "tag", Value: tag, Reason: reason, Err: ErrInvalidDurableName}
+		}
+	}
+
+	return nil
+}
+
+func checkName(name string) string {
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r) || !unicode.IsPrint(r):
+			return "must not contain whitespace or non-printable characters"
+		case strings.ContainsRune(".*>/\\", r):
+			return "must not contain '.', '*', '>', '/' or '\\'"
+		}
+	}
+
+	return ""
+}
+
+func checkSubject(subject string) string {
+	if strings.IndexFunc(subject, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return "must not contain whitespace or non-printable characters"
+	}
+
+	tokens := strings.Split(subject, dot)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return "must not contain empty tokens"
+		case token == ">" && i != len(tokens)-1:
+			return "must only use '>' as the last token"
+		case token != "*" && token != ">" && strings.ContainsAny(token, "*>"):
+			return "must only use wildcards as whole tokens"
+		}
+	}
+
+	return ""
+}
+
+func checkQueue(queue string) string {
+	if strings.IndexFunc(queue, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return "must not contain whitespace or non-printable characters"
+	}
+
+	return ""
+}
+
 func ReplaceIllegalCharacter(str string) string {
 	return illegalRegex.ReplaceAllString(str, dash)
 }
+
+func resolveNamespace(namespace string) string {
+	switch namespace {
+	case "":
+		return natsNamespace
+	case NoNamespace:
+		return ""
+	default:
+		return namespace
+	}
+}
+
+func withNamespace(namespace string, name string, separator string) string {
+	if namespace == "" {
+		return name
+	}
+
+	return namespace + separator + name
+}
+
+// registrations may happen before Connect sets the default namespace, so the registry keeps
+// raw registrations and resolves them on lookup, caching the results per namespace
+type subjectRegistry[V any] struct {
+	mu        sync.RWMutex
+	entries   []*subjectEntry[V]
+	namespace string
+	cache     map[string][]V
+}
+
+type subjectEntry[V any] struct {
+	id     string
+	key    func() string
+	values []V
+}
+
+func (r *subjectRegistry[V]) add(id string, key func() string, values ...V) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = nil
+	for _, e := range r.entries {
+		if e.id == id {
+			e.values = append(e.values, values...)
+			return
+		}
+	}
+	r.entries = append(r.entries, &subjectEntry[V]{id: id, key: key, values: values})
+}
+
+func (r *subjectRegistry[V]) set(id string, key func() string, values ...V) {
+	r.remove(id)
+	if len(values) > 0 {
+		r.add(id, key, values...)
+	}
+}
+
+func (r *subjectRegistry[V]) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = nil
+	r.entries = slices.DeleteFunc(r.entries, func(e *subjectEntry[V]) bool {
+		return e.id == id
+	})
+}
+
+func (r *subjectRegistry[V]) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = nil
+	r.entries = nil
+}
+
+func (r *subjectRegistry[V]) lookup(key string, match func(pattern string, key string) bool) []V {
+	r.mu.RLock()
+	if values, ok := r.cache[key]; ok && r.namespace == natsNamespace {
+		r.mu.RUnlock()
+		return values
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil || r.namespace != natsNamespace {
+		r.cache = map[string][]V{}
+		r.namespace = natsNamespace
+	}
+	var values []V
+	for _, e := range r.entries {
+		if match(e.key(), key) {
+			values = append(values, e.values...)
+		}
+	}
+	r.cache[key] = values
+
+	return values
+}
+
+func (r *subjectRegistry[V]) rangeEntries(fn func(key string, values []V)) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, e := range r.entries {
+		fn(e.key(), e.values)
+	}
+}
@@ -1,6 +1,7 @@
 package dgnats
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
@@ -24,10 +25,24 @@ var (
 )
 
 func Subscribe(ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsg(ctx, subject, dataWorkFn(workFn))
+}
+
+func SubscribeWithHeaders(ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, nats.Header, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsg(ctx, subject, headerWorkFn(workFn))
+}
+
+func subscribeMsg(ctx *dgctx.DgContext, subject *NatsSubject, workFn ConsumeHandler) (*nats.Subscription, error) {
 	if ctx == nil {
 		ctx = dgctx.SimpleDgContext()
 	}
-	err := InitStream(ctx, subject)
+	err := subject.validateSubscribe("")
+	if err != nil {
+		dglogger.Errorf(ctx, "validate subscribe subject error: %v", err)
+		return nil, err
+	}
+
+	err = InitStream(ctx, subject)
 	if err != nil {
 		return nil, err
 	}
@@ -41,38 +56,59 @@ func Subscribe(ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.Dg
 	subOpts := buildSubOpts(subject, "")
 
 	var sub *nats.Subscription
-	if subject.Group != "" {
-		sub, err = js.QueueSubscribe(subject.Name, subject.Group, func(msg *nats.Msg) {
-			subscribe(msg, workFn)
+	if subject.GetQueue() != "" {
+		sub, err = js.QueueSubscribe(subject.GetSubject(), subject.GetQueue(), func(msg *nats.Msg) {
+			subscribe(msg, subject, workFn)
 		}, subOpts...)
 	} else {
-		sub, err = js.Subscribe(subject.Name, func(msg *nats.Msg) {
-			subscribe(msg, workFn)
+		sub, err = js.Subscribe(subject.GetSubject(), func(msg *nats.Msg) {
+			subscribe(msg, subject, workFn)
 		}, subOpts...)
 	}
 	if err != nil {
-		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.Name, err)
+		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.GetSubject(), err)
 		return nil, err
 	}
 
 	return sub, nil
 }
 
-func subscribe(msg *nats.Msg, workFn func(*dgctx.DgContext, []byte) error) {
+func subscribe(msg *nats.Msg, subject *NatsSubject, workFn ConsumeHandler) {
 	ctx := buildDgContextFromMsg(msg)
-	err := workFn(ctx, msg.Data)
-	ackOrNakByError(msg, err)
+	if isStaleMsg(msg, subject) {
+		dglogger.Warnf(ctx, "drop stale subject[%s] message: %s", msg.Subject, msg.Header.Get(nats.MsgIdHdr))
+		if err := msg.AckSync(); err != nil {
+			dglogger.Errorf(ctx, "msg.AckSync error: %v", err)
+		}
+		return
+	}
+
+	workAndAck(ctx, msg, subject, "", workFn)
 }
 
 func SubscribeWithTag(ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn func(*dgctx.DgContext, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsgWithTag(ctx, subject, tag, dataWorkFn(workFn))
+}
+
+func SubscribeWithTagAndHeaders(ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn func(*dgctx.DgContext, nats.Header, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsgWithTag(ctx, subject, tag, headerWorkFn(workFn))
+}
+
+func subscribeMsgWithTag(ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn ConsumeHandler) (*nats.Subscription, error) {
 	if tag == "" {
-		return Subscribe(ctx, subject, workFn)
+		return subscribeMsg(ctx, subject, workFn)
 	}
 
 	if ctx == nil {
 		ctx = dgctx.SimpleDgContext()
 	}
-	err := InitStream(ctx, subject)
+	err := subject.validateSubscribe(tag)
+	if err != nil {
+		dglogger.Errorf(ctx, "validate subscribe subject error: %v", err)
+		return nil, err
+	}
+
+	err = InitStream(ctx, subject)
 	if err != nil {
 		return nil, err
 	}
@@ -86,40 +122,54 @@ func SubscribeWithTag(ctx *dgctx.DgContext, subject *NatsSubject, tag string, wo
 	subOpts := buildSubOpts(subject, tag)
 
 	var sub *nats.Subscription
-	if subject.Group != "" {
-		sub, err = js.QueueSubscribe(subject.Name, subject.Group, func(msg *nats.Msg) {
-			subscribeWithTag(msg, tag, workFn)
+	if subject.GetQueue() != "" {
+		sub, err = js.QueueSubscribe(subject.GetSubject(), subject.GetQueue(), func(msg *nats.Msg) {
+			subscribeWithTag(msg, subject, tag, workFn)
 		}, subOpts...)
 	} else {
-		sub, err = js.Subscribe(subject.Name, func(msg *nats.Msg) {
-			subscribeWithTag(msg, tag, workFn)
+		sub, err = js.Subscribe(subject.GetSubject(), func(msg *nats.Msg) {
+			subscribeWithTag(msg, subject, tag, workFn)
 		}, subOpts...)
 	}
 
 	if err != nil {
-		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.Name, err)
+		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.GetSubject(), err)
 		return nil, err
 	}
 
 	return sub, nil
 }
 
-func subscribeWithTag(msg *nats.Msg, tag string, workFn func(*dgctx.DgContext, []byte) error) {
+func subscribeWithTag(msg *nats.Msg, subject *NatsSubject, tag string, workFn ConsumeHandler) {
 	if len(msg.Header) == 0 {
 		return
 	}
 
 	header := msg.Header
-	if ts, ok := header[headerTag]; !ok || (len(ts) > 0 && ts[0] == tag) {
-		subscribe(msg, workFn)
+	if ts, ok := header[HeaderTag]; !ok || (len(ts) > 0 && ts[0] == tag) {
+		subscribe(msg, subject, workFn)
 	}
 }
 
 func SubscribeDelay(ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsgDelay(ctx, subject, sleepDuration, dataWorkFn(workFn))
+}
+
+func SubscribeDelayWithHeaders(ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, nats.Header, []byte) error) (*nats.Subscription, error) {
+	return subscribeMsgDelay(ctx, subject, sleepDuration, headerWorkFn(workFn))
+}
+
+func subscribeMsgDelay(ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn ConsumeHandler) (*nats.Subscription, error) {
 	if ctx == nil {
 		ctx = dgctx.SimpleDgContext()
 	}
-	err := InitStream(ctx, subject)
+	err := subject.validateSubscribe("")
+	if err != nil {
+		dglogger.Errorf(ctx, "validate subscribe subject error: %v", err)
+		return nil, err
+	}
+
+	err = InitStream(ctx, subject)
 	if err != nil {
 		return nil, err
 	}
@@ -130,30 +180,35 @@ func SubscribeDelay(ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration ti
 		return nil, err
 	}
 
+	err = startDelayScheduler(ctx, subject.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+
 	subOpts := buildSubOpts(subject, "")
 
 	var sub *nats.Subscription
-	if subject.Group != "" {
-		sub, err = js.QueueSubscribe(subject.Name, subject.Group, func(msg *nats.Msg) {
+	if subject.GetQueue() != "" {
+		sub, err = js.QueueSubscribe(subject.GetSubject(), subject.GetQueue(), func(msg *nats.Msg) {
 			subscribeDelay(msg, subject, sleepDuration, workFn)
 		}, subOpts...)
 	} else {
-		sub, err = js.Subscribe(subject.Name, func(msg *nats.Msg) {
+		sub, err = js.Subscribe(subject.GetSubject(), func(msg *nats.Msg) {
 			subscribeDelay(msg, subject, sleepDuration, workFn)
 		}, subOpts...)
 	}
 
 	if err != nil {
-		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.Name, err)
+		dglogger.Errorf(ctx, "subscribe subject[%s] error: %v", subject.GetSubject(), err)
 		return nil, err
 	}
 
 	return sub, nil
 }
 
-func subscribeDelay(msg *nats.Msg, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, []byte) error) {
+func subscribeDelay(msg *nats.Msg, subject *NatsSubject, sleepDuration time.Duration, workFn ConsumeHandler) {
 	ctx := buildDgContextFromMsg(msg)
-	delayHeader := msg.Header[headerDelay]
+	delayHeader := msg.Header[HeaderDelay]
 	if len(delayHeader) == 0 {
 		ase := msg.AckSync()
 		if ase != nil {
@@ -162,64 +217,116 @@ func subscribeDelay(msg *nats.Msg, subject *NatsSubject, sleepDuration time.Dura
 		return
 	}
 
-	pubAt, _ := strconv.ParseInt(msg.Header[headerPubAt][0], 10, 64)
+	pubAt, _ := strconv.ParseInt(msg.Header[HeaderPubAt][0], 10, 64)
 	delay, _ := strconv.ParseInt(delayHeader[0], 10, 64)
 
-	if time.Now().UnixNano() <= pubAt+delay {
+	if remaining := time.Duration(pubAt + delay - time.Now().UnixNano()); remaining > 0 {
 		dglogger.Debug(ctx, "not due, nak")
-		nwde := msg.NakWithDelay(sleepDuration)
+		nwde := msg.NakWithDelay(utils.IfReturn(remaining > sleepDuration, remaining, sleepDuration))
 		if nwde != nil {
 			dglogger.Errorf(ctx, "msg.NakWithDelay error: %v", nwde)
 		}
 		return
 	}
 
-	data := msg.Data
-	dglogger.Infof(ctx, "[%s] receive delay json message: %s", subject.Name, data)
-
-	workAndAck(ctx, msg, workFn)
+	workAndAck(ctx, msg, subject, "receive delay", workFn)
 }
 
 func SubscribeJson[T any](ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
-	return Subscribe(ctx, subject, func(ctx *dgctx.DgContext, data []byte) error {
-		t, err := utils.ConvertJsonBytesToBean[T](data)
-		if err != nil {
-			return err
-		}
-
-		return workFn(ctx, t)
-	})
+	return subscribeMsg(ctx, subject, typedWorkFn(JsonCodec, workFn))
 }
 
 func SubscribeJsonWithTag[T any](ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
-	return SubscribeWithTag(ctx, subject, tag, func(ctx *dgctx.DgContext, data []byte) error {
-		t, err := utils.ConvertJsonBytesToBean[T](data)
-		if err != nil {
-			return err
-		}
+	return subscribeMsgWithTag(ctx, subject, tag, typedWorkFn(JsonCodec, workFn))
+}
 
+func SubscribeJsonDelay[T any](ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
+	return subscribeMsgDelay(ctx, subject, sleepDuration, typedWorkFn(JsonCodec, workFn))
+}
+
+func SubscribeJsonWithHeaders[T any](ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, nats.Header, *T) error) (*nats.Subscription, error) {
+	return subscribeMsg(ctx, subject, typedHeaderWorkFn(JsonCodec, workFn))
+}
+
+func SubscribeTyped[T any](ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
+	codec, err := subject.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribeMsg(ctx, subject, typedWorkFn(codec, workFn))
+}
+
+func SubscribeTypedWithTag[T any](ctx *dgctx.DgContext, subject *NatsSubject, tag string, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
+	codec, err := subject.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribeMsgWithTag(ctx, subject, tag, typedWorkFn(codec, workFn))
+}
+
+func SubscribeTypedDelay[T any](ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
+	codec, err := subject.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribeMsgDelay(ctx, subject, sleepDuration, typedWorkFn(codec, workFn))
+}
+
+func SubscribeTypedWithHeaders[T any](ctx *dgctx.DgContext, subject *NatsSubject, workFn func(*dgctx.DgContext, nats.Header, *T) error) (*nats.Subscription, error) {
+	codec, err := subject.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribeMsg(ctx, subject, typedHeaderWorkFn(codec, workFn))
+}
+
+func dataWorkFn(workFn func(*dgctx.DgContext, []byte) error) ConsumeHandler {
+	return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+		return workFn(ctx, msg.Data)
+	}
+}
+
+func headerWorkFn(workFn func(*dgctx.DgContext, nats.Header, []byte) error) ConsumeHandler {
+	return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+		return workFn(ctx, msg.Header, msg.Data)
+	}
+}
+
+func typedWorkFn[T any](fallback Codec, workFn func(*dgctx.DgContext, *T) error) ConsumeHandler {
+	return typedHeaderWorkFn(fallback, func(ctx *dgctx.DgContext, _ nats.Header, t *T) error {
 		return workFn(ctx, t)
 	})
 }
 
-func SubscribeJsonDelay[T any](ctx *dgctx.DgContext, subject *NatsSubject, sleepDuration time.Duration, workFn func(*dgctx.DgContext, *T) error) (*nats.Subscription, error) {
-	return SubscribeDelay(ctx, subject, sleepDuration, func(ctx *dgctx.DgContext, data []byte) error {
-		t, err := utils.ConvertJsonBytesToBean[T](data)
+func typedHeaderWorkFn[T any](fallback Codec, workFn func(*dgctx.DgContext, nats.Header, *T) error) ConsumeHandler {
+	return func(ctx *dgctx.DgContext, msg *nats.Msg) error {
+		t, err := decodeMsg[T](msg, fallback)
 		if err != nil {
+			dglogger.Errorf(ctx, "decode subject[%s] message error: %v", msg.Subject, err)
 			return err
 		}
 
-		return workFn(ctx, t)
-	})
+		return workFn(ctx, msg.Header, t)
+	}
 }
 
 func Unsubscribe(ctx *dgctx.DgContext, subject *NatsSubject, tag string) error {
+	err := subject.validateSubscribe(tag)
+	if err != nil {
+		dglogger.Errorf(ctx, "validate subscribe subject error: %v", err)
+		return err
+	}
+
 	js, err := GetJs()
 	if err != nil {
 		dglogger.Errorf(ctx, "GetJs error: %v", err)
 		return err
 	}
-	err = js.DeleteConsumer(subject.Category, subject.GetDurable(tag))
+	err = js.DeleteConsumer(subject.GetStream(), subject.GetDurable(tag))
 	if err != nil {
 		dglogger.Errorf(ctx, "js.DeleteConsumer error: %v", err)
 	}
@@ -241,20 +348,70 @@ func buildDgContextFromMsg(msg *nats.Msg) *dgctx.DgContext {
 func buildSubOpts(subject *NatsSubject, tag string) []nats.SubOpt {
 	var subOpts []nats.SubOpt
 	subOpts = append(subOpts, DefaultSubOpts...)
-	subOpts = append(subOpts, nats.Durable(subject.GetDurable(tag)), nats.BindStream(subject.Category))
+	subOpts = append(subOpts, nats.Durable(subject.GetDurable(tag)), nats.BindStream(subject.GetStream()))
 	if subject.MaxAckPendingCount > 0 {
 		subOpts = append(subOpts, nats.MaxAckPending(subject.MaxAckPendingCount))
 	}
 	return subOpts
 }
 
-func workAndAck(ctx *dgctx.DgContext, msg *nats.Msg, workFn func(*dgctx.DgContext, []byte) error) {
-	err := workFn(ctx, msg.Data)
+func workAndAck(ctx *dgctx.DgContext, msg *nats.Msg, subject *NatsSubject, payloadLogAction string, workFn ConsumeHandler) {
+	if !decodePayload(ctx, msg) {
+		return
+	}
+	if payloadLogAction != "" {
+		logPayload(ctx, payloadLogAction, subject, msg)
+	}
+
+	err := chainConsume(msg.Subject, workFn)(ctx, msg)
 	ackOrNakByError(msg, err)
 }
 
-func ackOrNakByError(msg *nats.Msg, err error) {
+func decodePayload(ctx *dgctx.DgContext, msg *nats.Msg) bool {
+	if err := inlineClaimCheck(msg); err != nil {
+		dglogger.Errorf(ctx, "inline subject[%s] claim check[%s] error: %v", msg.Subject, msg.Header.Get(HeaderClaimCheck), err)
+		if errors.Is(err, ErrClaimCheckNotFound) {
+			_ = msg.Term()
+		} else {
+			_ = msg.NakWithDelay(SubWorkErrorRetryWait)
+		}
+		return false
+	}
+	if err := decryptMsg(msg); err != nil {
+		if isUndecryptableMsg(err) {
+			quarantineMsg(ctx, msg, err)
+		} else {
+			dglogger.Errorf(ctx, "decrypt subject[%s] message error: %v", msg.Subject, err)
+			_ = msg.NakWithDelay(SubWorkErrorRetryWait)
+		}
+		return false
+	}
+	if err := decompressMsg(msg); err != nil {
+		dglogger.Errorf(ctx, "decompress subject[%s] message error: %v", msg.Subject, err)
+		_ = msg.Term()
+		return false
+	}
+
+	return true
+}
+
+func isStaleMsg(msg *nats.Msg, subject *NatsSubject) bool {
+	if subject.StaleAfter <= 0 {
+		return false
+	}
+
+	meta, err := msg.Metadata()
 	if err != nil {
+		return false
+	}
+
+	return time.Since(meta.Timestamp) > subject.StaleAfter
+}
+
+func ackOrNakByError(msg *nats.Msg, err error) {
+	if errors.Is(err, ErrSchemaValidation) || errors.Is(err, ErrInvalidCloudEvent) {
+		_ = msg.Term()
+	} else if err != nil {
 		_ = msg.NakWithDelay(SubWorkErrorRetryWait)
 	} else {
 		_ = msg.AckSync()
@@ -0,0 +1,92 @@
+package dgnats
+
+import (
+	"sync"
+	"time"
+)
+
+type timerTask struct {
+	rounds int
+	fn     func()
+}
+
+type timerWheel struct {
+	mu     sync.Mutex
+	tick   time.Duration
+	slots  [][]*timerTask
+	pos    int
+	stopCh chan struct{}
+}
+
+func newTimerWheel(tick time.Duration, slotCount int) *timerWheel {
+	tw := &timerWheel{
+		tick:   tick,
+		slots:  make([][]*timerTask, slotCount),
+		stopCh: make(chan struct{}),
+	}
+	go tw.run()
+
+	return tw
+}
+
+func (tw *timerWheel) horizon() time.Duration {
+	return tw.tick * time.Duration(len(tw.slots))
+}
+
+func (tw *timerWheel) add(due time.Time, fn func()) {
+	// one extra tick since the current slot may already be partially elapsed
+	ticks := int((time.Until(due)+tw.tick-1)/tw.tick) + 1
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	slot := (tw.pos + ticks) % len(tw.slots)
+	tw.slots[slot] = append(tw.slots[slot], &timerTask{rounds: (ticks - 1) / len(tw.slots), fn: fn})
+}
+
+func (tw *timerWheel) stop() {
+	close(tw.stopCh)
+}
+
+func (tw *timerWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tw.stopCh:
+			return
+		case <-ticker.C:
+			if due := tw.advance(); len(due) > 0 {
+				go func() {
+					for _, task := range due {
+						task.fn()
+					}
+				}()
+			}
+		}
+	}
+}
+
+func (tw *timerWheel) advance() []*timerTask {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.pos = (tw.pos + 1) % len(tw.slots)
+
+	var due, pending []*timerTask
+	for _, task := range tw.slots[tw.pos] {
+		if task.rounds > 0 {
+			task.rounds--
+			pending = append(pending, task)
+		} else {
+			due = append(due, task)
+		}
+	}
+	tw.slots[tw.pos] = pending
+
+	return due
+}
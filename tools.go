@@ -1,8 +1,11 @@
 package dgnats
 
 import (
+	"context"
+	"errors"
+	"strconv"
+
 	dgctx "github.com/darwinOrg/go-common/context"
-	"github.com/darwinOrg/go-common/utils"
 	dglogger "github.com/darwinOrg/go-logger"
 )
 
@@ -13,12 +16,61 @@ func ToBytes(ctx *dgctx.DgContext, message any) ([]byte, error) {
 	case []byte:
 		return message.([]byte), nil
 	default:
-		jsonMsg, err := utils.ConvertBeanToJsonString(message)
+		codec, _ := GetCodec("")
+		bytes, err := codec.Marshal(message)
 		if err != nil {
-			dglogger.Errorf(ctx, "ConvertBeanToJsonString error | err: %v", err)
+			dglogger.Errorf(ctx, "%s marshal error | err: %v", codec.ContentType(), err)
 			return nil, err
 		}
 
-		return []byte(jsonMsg), nil
+		return bytes, nil
+	}
+}
+
+func encodePayload(ctx *dgctx.DgContext, subject *NatsSubject, message any) ([]byte, map[string][]string, error) {
+	header := map[string][]string{}
+	switch message.(type) {
+	case string, []byte:
+		bytes, err := ToBytes(ctx, message)
+		return bytes, header, err
+	}
+
+	codec, err := subject.codec()
+	if err != nil {
+		dglogger.Errorf(ctx, "get subject[%s] codec[%s] error: %v", subject.GetSubject(), subject.Codec, err)
+		return nil, nil, err
+	}
+	bytes, err := codec.Marshal(message)
+	if err != nil {
+		dglogger.Errorf(ctx, "%s marshal error | err: %v", codec.ContentType(), err)
+		return nil, nil, err
+	}
+	header[HeaderContentType] = []string{codec.ContentType()}
+	if version, ok := msgVersionOf(message); ok {
+		header[HeaderMsgVersion] = []string{strconv.Itoa(version)}
+	}
+
+	if codec.ContentType() == ContentTypeJson {
+		version, err := validateSchema(subject.GetSubject(), 0, bytes)
+		if errors.Is(err, ErrSchemaValidation) || (err != nil && SchemaFailClosed) {
+			dglogger.Errorf(ctx, "validate subject[%s] schema error: %v", subject.GetSubject(), err)
+			return nil, nil, err
+		}
+		if err != nil {
+			dglogger.Warnf(ctx, "load subject[%s] schema error: %v", subject.GetSubject(), err)
+		}
+		if version > 0 {
+			header[HeaderSchemaVersion] = []string{strconv.Itoa(version)}
+		}
+	}
+
+	return bytes, header, nil
+}
+
+func innerContext(ctx *dgctx.DgContext) context.Context {
+	if ctx != nil && ctx.GetInnerContext() != nil {
+		return ctx.GetInnerContext()
 	}
+
+	return context.Background()
 }
@@ -0,0 +1,73 @@
+package dgnats
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+const defaultMsgVersion = 1
+
+var (
+	msgVersions = map[reflect.Type]int{}
+	upcasters   = map[reflect.Type]map[int]func([]byte) ([]byte, error){}
+	upcasterMu  sync.RWMutex
+)
+
+func RegisterMsgVersion[T any](version int) {
+	upcasterMu.Lock()
+	defer upcasterMu.Unlock()
+
+	msgVersions[reflect.TypeFor[T]()] = version
+}
+
+func RegisterUpcaster[T any](fromVersion int, fn func(data []byte) ([]byte, error)) {
+	upcasterMu.Lock()
+	defer upcasterMu.Unlock()
+
+	t := reflect.TypeFor[T]()
+	if upcasters[t] == nil {
+		upcasters[t] = map[int]func([]byte) ([]byte, error){}
+	}
+	upcasters[t][fromVersion] = fn
+}
+
+func msgVersionOf(obj any) (int, bool) {
+	t := reflect.TypeOf(obj)
+	if t == nil {
+		return 0, false
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	upcasterMu.RLock()
+	defer upcasterMu.RUnlock()
+
+	version, ok := msgVersions[t]
+	return version, ok
+}
+
+func upcastMsg[T any](msg *nats.Msg) ([]byte, error) {
+	version := defaultMsgVersion
+	if v, err := strconv.Atoi(msg.Header.Get(HeaderMsgVersion)); err == nil {
+		version = v
+	}
+
+	upcasterMu.RLock()
+	chain := upcasters[reflect.TypeFor[T]()]
+	upcasterMu.RUnlock()
+
+	data := msg.Data
+	for fn, ok := chain[version]; ok; fn, ok = chain[version] {
+		var err error
+		if data, err = fn(data); err != nil {
+			return nil, err
+		}
+		version++
+	}
+
+	return data, nil
+}